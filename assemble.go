@@ -0,0 +1,682 @@
+package bbcdisasm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Limits of the assembler
+const (
+	maxAssemblyPasses = 8  // passes made to settle the values of symbols
+	maxAssemblyDepth  = 64 // nesting of INCLUDE files and macros
+)
+
+// Assembly is the memory image and files produced by an Assembler
+type Assembly struct {
+	Memory  [0x10000]byte
+	Written [0x10000]bool   // the addresses assembled to
+	Symbols map[string]int  // the symbols outside any scope
+	Files   []AssembledFile // the files of SAVE and PUTFILE in order
+}
+
+// AssembledFile is a file saved by SAVE or added with PUTFILE
+type AssembledFile struct {
+	Name string
+	Load uint
+	Exec uint
+	Data []byte
+}
+
+// Assembler assembles source in the syntax of beebasm:
+//  - labels, .label, which are local to the enclosing { } block, FOR loop or
+//    macro unless written .*label
+//  - symbol assignments, name = expr
+//  - the documented instructions of the 6502, or of the 65C02 after CPU 1
+//  - data, EQUB, EQUW, EQUD and EQUS
+//  - ORG, CPU, GUARD, SKIP and ALIGN
+//  - INCLUDE "file" and INCBIN "file"
+//  - MACRO name arg, ... ENDMACRO and FOR var, start, end[, step] ... NEXT
+//  - IF cond ... ELIF cond ... ELSE ... ENDIF
+//  - SAVE ["name",] start, end[, exec[, load]] and
+//    PUTFILE "host file", ["name",] load[, exec]
+//  - comments starting \ or ; and statements separated by :
+// Expressions may use P%, symbols, numbers in decimal, &hex, $hex or %binary,
+// the BBC BASIC operators and the LO and HI functions.
+type Assembler struct {
+	// ReadFile reads the files named by INCLUDE, INCBIN and PUTFILE
+	ReadFile func(name string) ([]byte, error)
+
+	// Output is the name of the file written by SAVE without a name
+	Output string
+
+	// State of the assembly. Symbols are kept between passes by their name
+	// qualified with the scope they belong to.
+	symbols   map[string]int
+	out       *Assembly // nil before the final pass
+	pc        int
+	cpu       CPU
+	guards    map[int]bool
+	macros    map[string]*macro
+	scopes    []int // the scopes enclosing the current statement
+	nextScope int
+	depth     int
+	defined   map[string]bool // symbols defined in this pass
+	changed   bool            // a symbol has a different value to the last pass
+	undefined bool            // a symbol was used before it was defined
+}
+
+// NewAssembler returns an Assembler reading files from the file system
+func NewAssembler() *Assembler {
+	return &Assembler{ReadFile: ioutil.ReadFile}
+}
+
+// Assemble assembles source with a new Assembler, see Assembler.Assemble
+func Assemble(src io.Reader) (*Assembly, error) {
+	return NewAssembler().Assemble("", src)
+}
+
+// AssembleFile reads and assembles the named source file
+func (a *Assembler) AssembleFile(name string) (*Assembly, error) {
+	text, err := a.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Assemble(name, bytes.NewReader(text))
+}
+
+// Assemble assembles the source read from src. The name of the source is used
+// in error messages.
+func (a *Assembler) Assemble(name string, src io.Reader) (*Assembly, error) {
+	text, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	stmts := parseSource(name, string(text))
+	a.symbols = make(map[string]int)
+
+	// Forward references take the value from the previous pass, so passes
+	// are repeated until no symbol changes. Only the final pass writes memory
+	// and reports values that are out of range.
+	for pass := 0; ; pass++ {
+		if pass == maxAssemblyPasses {
+			return nil, errors.New("the values of the symbols did not settle")
+		}
+		if err := a.pass(stmts, nil); err != nil {
+			return nil, err
+		}
+		if !a.changed {
+			// The final pass reports any symbol that is still undefined
+			break
+		}
+	}
+	out := &Assembly{Symbols: make(map[string]int)}
+	if err := a.pass(stmts, out); err != nil {
+		return nil, err
+	}
+	for name, val := range a.symbols {
+		if !strings.Contains(name, "@") {
+			out.Symbols[name] = val
+		}
+	}
+	return out, nil
+}
+
+// statement is a statement of the source and where it is from
+type statement struct {
+	text string
+	file string
+	line int
+}
+
+// errorf returns an error located at the statement
+func (s statement) errorf(format string, args ...interface{}) error {
+	return &sourceError{s.file, s.line, fmt.Sprintf(format, args...)}
+}
+
+// sourceError is an error in a statement of the source
+type sourceError struct {
+	file string
+	line int
+	msg  string
+}
+
+func (e *sourceError) Error() string {
+	if e.file == "" {
+		return fmt.Sprintf("line %d: %s", e.line, e.msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.file, e.line, e.msg)
+}
+
+// parseSource splits source into statements
+func parseSource(name, text string) []statement {
+	var stmts []statement
+	for i, line := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n") {
+		for _, s := range splitStatements(line) {
+			if s = strings.TrimSpace(s); s != "" {
+				stmts = append(stmts, statement{s, name, i + 1})
+			}
+		}
+	}
+	return stmts
+}
+
+// errUndefined is returned by expressions referencing an unknown symbol
+var errUndefined = errors.New("undefined symbol")
+
+// pass assembles the program once, into out if it is the final pass
+func (a *Assembler) pass(stmts []statement, out *Assembly) error {
+	a.out = out
+	a.pc = 0
+	a.cpu = CPU6502
+	a.guards = make(map[int]bool)
+	a.macros = make(map[string]*macro)
+	a.scopes = []int{0}
+	a.nextScope = 1
+	a.depth = 0
+	a.defined = make(map[string]bool)
+	a.changed = false
+	a.undefined = false
+	return a.run(stmts)
+}
+
+// splitStatements splits a line into its statements, dropping the comment.
+// The braces of a block are statements of their own.
+func splitStatements(line string) []string {
+	var stmts []string
+	start := 0
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ':':
+			stmts = append(stmts, line[start:i])
+			start = i + 1
+		case c == '{' || c == '}':
+			stmts = append(stmts, line[start:i], line[i:i+1])
+			start = i + 1
+		case c == '\\' || c == ';':
+			return append(stmts, line[start:i])
+		}
+	}
+	return append(stmts, line[start:])
+}
+
+// statement assembles a single statement other than the start or end of a
+// block
+func (a *Assembler) statement(stmt string) error {
+	if stmt == "" {
+		return nil
+	}
+
+	if stmt[0] == '.' {
+		global := strings.HasPrefix(stmt, ".*")
+		name := strings.TrimPrefix(stmt[1:], "*")
+		n := identLength(name)
+		if n == 0 {
+			return fmt.Errorf("invalid label %q", stmt)
+		}
+		if err := a.define(name[:n], a.pc, global); err != nil {
+			return err
+		}
+		return a.statement(strings.TrimSpace(name[n:]))
+	}
+
+	n := identLength(stmt)
+	if n == 0 {
+		return fmt.Errorf("syntax error %q", stmt)
+	}
+	word, rest := stmt[:n], strings.TrimSpace(stmt[n:])
+	if strings.HasPrefix(rest, "=") && !strings.HasPrefix(rest, "==") {
+		if word == "P%" {
+			return errors.New("P% cannot be assigned, use ORG")
+		}
+		val, err := a.eval(rest[1:])
+		if err != nil {
+			return err
+		}
+		return a.define(word, val, false)
+	}
+
+	switch strings.ToUpper(word) {
+	case "ORG":
+		val, err := a.eval(rest)
+		if err != nil {
+			return err
+		}
+		if err := a.checkRange(val, 0, 0xFFFF); err != nil {
+			return err
+		}
+		a.pc = val
+		return nil
+	case "CPU":
+		val, err := a.eval(rest)
+		if err != nil {
+			return err
+		}
+		switch val {
+		case 0:
+			a.cpu = CPU6502
+		case 1:
+			a.cpu = CPU65C02
+		default:
+			return fmt.Errorf("unknown CPU %d", val)
+		}
+		return nil
+	case "EQUB", "EQUS":
+		return a.data(rest, 1)
+	case "EQUW":
+		return a.data(rest, 2)
+	case "EQUD":
+		return a.data(rest, 4)
+	case "GUARD":
+		val, err := a.eval(rest)
+		if err != nil {
+			return err
+		}
+		a.guards[val] = true
+		return nil
+	case "SKIP":
+		val, err := a.eval(rest)
+		if err != nil {
+			return err
+		}
+		if err := a.checkRange(val, 0, 0x10000); err != nil {
+			return err
+		}
+		return a.advance(val)
+	case "ALIGN":
+		val, err := a.eval(rest)
+		if err != nil {
+			return err
+		}
+		if val <= 0 {
+			return fmt.Errorf("invalid alignment %d", val)
+		}
+		return a.advance((val - a.pc%val) % val)
+	case "INCLUDE":
+		return a.include(rest)
+	case "INCBIN":
+		return a.incbin(rest)
+	case "SAVE":
+		return a.save(rest)
+	case "PUTFILE":
+		return a.putfile(rest)
+	}
+
+	if m, ok := a.macros[word]; ok {
+		return a.expand(m, rest)
+	}
+	if modes, ok := assemblerOpcodes(a.cpu)[strings.ToUpper(word)]; ok {
+		return a.instruction(strings.ToUpper(word), modes, rest)
+	}
+	return fmt.Errorf("unknown instruction or directive %q", word)
+}
+
+// define sets the value of a symbol in the current scope, or outside any scope
+// if global is true
+func (a *Assembler) define(name string, val int, global bool) error {
+	scope := a.scopes[len(a.scopes)-1]
+	if global {
+		scope = 0
+	}
+	key := scopedName(name, scope)
+	if a.defined[key] {
+		return fmt.Errorf("%s is already defined", name)
+	}
+	a.defined[key] = true
+	if old, ok := a.symbols[key]; !ok || old != val {
+		a.changed = true
+	}
+	a.symbols[key] = val
+	return nil
+}
+
+// scopedName returns the name a symbol is kept under
+func scopedName(name string, scope int) string {
+	if scope == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s@%d", name, scope)
+}
+
+// data assembles a list of strings and values of size bytes each
+func (a *Assembler) data(list string, size int) error {
+	if list == "" {
+		return errors.New("missing data")
+	}
+	for _, item := range splitTopLevel(list, ',') {
+		item = strings.TrimSpace(item)
+		if s, ok := stringLiteral(item); ok {
+			if err := a.emit([]byte(s)...); err != nil {
+				return err
+			}
+			continue
+		}
+		val, err := a.eval(item)
+		if err != nil {
+			return err
+		}
+		switch size {
+		case 1:
+			err = a.checkRange(val, -128, 0xFF)
+		case 2:
+			err = a.checkRange(val, -0x8000, 0xFFFF)
+		}
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			if err := a.emit(byte(val >> (8 * i))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// instruction assembles an instruction given the opcodes of its addressing
+// modes
+func (a *Assembler) instruction(name string, modes map[AddressingMode]byte, operand string) error {
+	if op, ok := modes[None]; ok && isBranch(name) {
+		target, err := a.eval(operand)
+		if err != nil {
+			return err
+		}
+		offset := target - (a.pc + 2)
+		if a.out != nil && (offset < -128 || offset > 127) {
+			return fmt.Errorf("branch to &%04X is out of range", target)
+		}
+		return a.emit(op, byte(offset))
+	}
+
+	expr, zp, abs := parseOperand(operand)
+	if zp == None && abs == None {
+		if op, ok := modes[Accumulator]; ok && (operand == "" || strings.EqualFold(operand, "A")) {
+			return a.emit(op)
+		}
+		if op, ok := modes[None]; ok && operand == "" {
+			return a.emit(op)
+		}
+		return fmt.Errorf("invalid operand %q for %s", operand, name)
+	}
+
+	val, known, err := a.value(expr)
+	if err != nil {
+		return err
+	}
+	if zp == Immediate {
+		op, ok := modes[Immediate]
+		if !ok {
+			return fmt.Errorf("%s does not have immediate addressing", name)
+		}
+		if err := a.checkRange(val, -128, 0xFF); err != nil {
+			return err
+		}
+		return a.emit(op, byte(val))
+	}
+
+	// Zero page addressing is used when the address is known to fit
+	zpOp, hasZP := modes[zp]
+	absOp, hasAbs := modes[abs]
+	hasZP, hasAbs = hasZP && zp != None, hasAbs && abs != None
+	switch {
+	case hasZP && (!hasAbs || (known && val >= 0 && val < 0x100)):
+		if a.out != nil && (val < 0 || val > 0xFF) {
+			return fmt.Errorf("address &%X is not in zero page", val)
+		}
+		return a.emit(zpOp, byte(val))
+	case hasAbs:
+		if err := a.checkRange(val, 0, 0xFFFF); err != nil {
+			return err
+		}
+		return a.emit(absOp, byte(val), byte(val>>8))
+	}
+	return fmt.Errorf("invalid addressing mode for %s", name)
+}
+
+// parseOperand returns the expression of an operand and the zero page and
+// absolute forms of its addressing mode, either of which may be None. The
+// immediate mode is returned as the zero page form.
+func parseOperand(operand string) (expr string, zp, abs AddressingMode) {
+	operand = strings.TrimSpace(operand)
+	if operand == "" || strings.EqualFold(operand, "A") {
+		return "", None, None
+	}
+	if operand[0] == '#' {
+		return operand[1:], Immediate, None
+	}
+
+	if operand[0] == '(' {
+		if end := closingParen(operand); end > 0 {
+			inner, after := operand[1:end], strings.TrimSpace(operand[end+1:])
+			switch {
+			case after == "":
+				if parts := splitTopLevel(inner, ','); len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[1]), "X") {
+					return parts[0], IndirectX, AbsoluteIndirectX
+				}
+				return inner, ZeroPageIndirect, Indirect
+			case isIndex(after, "Y"):
+				return inner, IndirectY, None
+			}
+		}
+	}
+
+	parts := splitTopLevel(operand, ',')
+	if len(parts) == 2 {
+		switch strings.ToUpper(strings.TrimSpace(parts[1])) {
+		case "X":
+			return parts[0], ZeroPageX, AbsoluteX
+		case "Y":
+			return parts[0], ZeroPageY, AbsoluteY
+		}
+	}
+	return operand, ZeroPage, Absolute
+}
+
+// isIndex is true if s is a comma followed by the index register reg
+func isIndex(s, reg string) bool {
+	return strings.HasPrefix(s, ",") && strings.EqualFold(strings.TrimSpace(s[1:]), reg)
+}
+
+// closingParen returns the index of the parenthesis that closes the one at the
+// start of s, or -1
+func closingParen(s string) int {
+	depth := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s at the separators outside parentheses and strings
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stringLiteral returns the contents of a quoted string. A quote is written
+// inside the string as "".
+func stringLiteral(s string) (string, bool) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return "", false
+	}
+	inner := s[1 : len(s)-1]
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '"' {
+			if i+1 == len(inner) || inner[i+1] != '"' {
+				return "", false
+			}
+			i++
+		}
+	}
+	return strings.ReplaceAll(inner, `""`, `"`), true
+}
+
+// emit writes bytes at P%, which is advanced past them
+func (a *Assembler) emit(bs ...byte) error {
+	for _, b := range bs {
+		if a.out != nil {
+			switch {
+			case a.pc > 0xFFFF:
+				return errors.New("assembled past the end of memory")
+			case a.guards[a.pc]:
+				return fmt.Errorf("assembled over the guard at &%04X", a.pc)
+			case a.out.Written[a.pc]:
+				return fmt.Errorf("&%04X has already been assembled", a.pc)
+			}
+			a.out.Memory[a.pc] = b
+			a.out.Written[a.pc] = true
+		}
+		a.pc++
+	}
+	return nil
+}
+
+// advance moves P% on by n bytes without assembling them
+func (a *Assembler) advance(n int) error {
+	a.pc += n
+	if a.out != nil && a.pc > 0x10000 {
+		return errors.New("assembled past the end of memory")
+	}
+	return nil
+}
+
+// checkRange returns an error in the final pass if val is outside min..max
+func (a *Assembler) checkRange(val, min, max int) error {
+	if a.out != nil && (val < min || val > max) {
+		return fmt.Errorf("value &%X is out of range", val)
+	}
+	return nil
+}
+
+// eval evaluates an expression
+func (a *Assembler) eval(expr string) (int, error) {
+	val, _, err := a.value(expr)
+	return val, err
+}
+
+// value evaluates an expression, returning false if it refers to a symbol that
+// is not yet defined. This is only an error in the final pass.
+func (a *Assembler) value(expr string) (int, bool, error) {
+	p := exprParser{s: expr, a: a}
+	val, err := p.parse()
+	if err == errUndefined {
+		if a.out == nil {
+			a.undefined = true
+			return 0, false, nil
+		}
+		return 0, false, fmt.Errorf("undefined symbol %s", p.name)
+	}
+	return val, true, err
+}
+
+// lookup returns the value of a symbol from the innermost scope defining it
+func (a *Assembler) lookup(name string) (int, bool) {
+	if name == "P%" {
+		return a.pc, true
+	}
+	for i := len(a.scopes) - 1; i >= 0; i-- {
+		if val, ok := a.symbols[scopedName(name, a.scopes[i])]; ok {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+// identLength returns the length of the identifier at the start of s. An
+// identifier may end with % or $, like CODE%.
+func identLength(s string) int {
+	n := 0
+	for n < len(s) && (isLetter(s[n]) || s[n] == '_' || (n > 0 && isDigit(s[n]))) {
+		n++
+	}
+	if n > 0 && n < len(s) && (s[n] == '%' || s[n] == '$') {
+		n++
+	}
+	return n
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isBranch(name string) bool {
+	for _, b := range branchInstructions {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Maps from mnemonic and addressing mode to opcode byte for the assembler.
+// Initialized by init()
+var asmOpcodes6502, asmOpcodes65C02 map[string]map[AddressingMode]byte
+
+func init() {
+	asmOpcodes6502 = buildAssemblerOpcodes(OpCodes)
+	asmOpcodes65C02 = buildAssemblerOpcodes(OpCodes, OpCodes65C02)
+}
+
+// buildAssemblerOpcodes merges the opcode tables into a map from mnemonic and
+// addressing mode to opcode byte
+func buildAssemblerOpcodes(tables ...[]Opcode) map[string]map[AddressingMode]byte {
+	m := make(map[string]map[AddressingMode]byte)
+	for _, table := range tables {
+		for _, op := range table {
+			if m[op.Name] == nil {
+				m[op.Name] = make(map[AddressingMode]byte)
+			}
+			m[op.Name][op.AddrMode] = op.Value
+		}
+	}
+	return m
+}
+
+// assemblerOpcodes returns the instructions beebasm assembles for the CPU.
+// The Rockwell bit manipulation instructions are not supported.
+func assemblerOpcodes(cpu CPU) map[string]map[AddressingMode]byte {
+	if cpu.CMOS() {
+		return asmOpcodes65C02
+	}
+	return asmOpcodes6502
+}
@@ -1,6 +1,7 @@
 package bbcdisasm
 
 import (
+	"fmt"
 	"strings"
 )
 
@@ -59,6 +60,25 @@ func ParseDFS(dfs []byte) *DiskImage {
 	return img
 }
 
+// Find returns the catalog entry for the named file
+func (img *DiskImage) Find(name string) (*Catalog, bool) {
+	for i := range img.Files {
+		if img.Files[i].Filename == name {
+			return &img.Files[i], true
+		}
+	}
+	return nil, false
+}
+
+// Contents returns the data of the file from the disk image data
+func (f *Catalog) Contents(dfs []byte) ([]byte, error) {
+	offset := f.StartSector * 256
+	if offset+f.Length > len(dfs) {
+		return nil, fmt.Errorf("file %s extends past the end of the disk image", f.Filename)
+	}
+	return dfs[offset:(offset + f.Length)], nil
+}
+
 func readFilename(block []byte) (string, byte) {
 	if len(block) < 7 {
 		panic("block is too short")
@@ -75,3 +95,86 @@ func readFilename(block []byte) (string, byte) {
 
 	return strings.TrimRight(string(name), " "), attr
 }
+
+// BuildDFS returns a DFS disk image holding the files of img with their
+// contents. The image has img.Sectors sectors, 800 for a single sided 80 track
+// disk if zero. The files are laid out in order from sector 2, setting the
+// Length and StartSector of each catalog entry.
+func BuildDFS(img *DiskImage, contents [][]byte) ([]byte, error) {
+	if len(img.Files) != len(contents) {
+		return nil, fmt.Errorf("%d files but %d contents", len(img.Files), len(contents))
+	}
+	if len(img.Files) > 31 {
+		return nil, fmt.Errorf("%d files but a DFS catalog holds 31", len(img.Files))
+	}
+	if len(img.Title) > 12 {
+		return nil, fmt.Errorf("disk title %q is longer than 12 characters", img.Title)
+	}
+	if img.Sectors == 0 {
+		img.Sectors = 800
+	}
+	if img.Sectors < 2 || img.Sectors > 0x3FF {
+		return nil, fmt.Errorf("invalid number of sectors %d", img.Sectors)
+	}
+
+	sector := 2
+	for i := range img.Files {
+		file := &img.Files[i]
+		if len(file.Filename) == 0 || len(file.Filename) > 7 {
+			return nil, fmt.Errorf("invalid DFS file name %q", file.Filename)
+		}
+		if len(file.Dir) != 1 {
+			return nil, fmt.Errorf("invalid directory %q for %s", file.Dir, file.Filename)
+		}
+		file.Length = len(contents[i])
+		file.StartSector = sector
+		sector += (file.Length + 255) / 256
+		if sector > img.Sectors {
+			return nil, fmt.Errorf("the disk is full at %s.%s", file.Dir, file.Filename)
+		}
+	}
+
+	dfs := make([]byte, img.Sectors*256)
+	title := []byte(img.Title + strings.Repeat("\000", 12-len(img.Title)))
+	copy(dfs[0:8], title[:8])
+	copy(dfs[0x100:0x104], title[8:])
+	dfs[0x104] = byte(img.Cycle)
+	dfs[0x105] = byte(len(img.Files) * 8)
+	dfs[0x106] = byte(img.BootOpt&3)<<4 | byte(img.Sectors>>8)
+	dfs[0x107] = byte(img.Sectors)
+
+	// The catalog is ordered by descending start sector
+	for i := range img.Files {
+		file := &img.Files[len(img.Files)-1-i]
+
+		offset := 0x008 + i*8
+		writeFilename(dfs[offset:offset+7], file.Filename, file.Attr)
+		dfs[offset+7] = file.Dir[0]
+
+		offset = 0x108 + i*8
+		dfs[offset+0] = byte(file.LoadAddr)
+		dfs[offset+1] = byte(file.LoadAddr >> 8)
+		dfs[offset+2] = byte(file.ExecAddr)
+		dfs[offset+3] = byte(file.ExecAddr >> 8)
+		dfs[offset+4] = byte(file.Length)
+		dfs[offset+5] = byte(file.Length >> 8)
+		dfs[offset+6] = byte(file.ExecAddr>>10)&0b11000000 | byte(file.Length>>12)&0b110000 |
+			byte(file.LoadAddr>>14)&0b1100 | byte(file.StartSector>>8)&0b11
+		dfs[offset+7] = byte(file.StartSector)
+
+		copy(dfs[file.StartSector*256:], contents[len(img.Files)-1-i])
+	}
+	return dfs, nil
+}
+
+// writeFilename writes a file name padded with spaces, with the attributes in
+// the top bits of the characters. See readFilename.
+func writeFilename(block []byte, name string, attr byte) {
+	for i := range block {
+		block[i] = ' '
+		if i < len(name) {
+			block[i] = name[i]
+		}
+		block[i] |= (attr >> i & 1) << 7
+	}
+}
@@ -0,0 +1,175 @@
+package bbcdisasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// CallGraphNode is a subroutine in the call graph: the start of the program,
+// the target of a JSR or, outside the program, the target of a JMP
+type CallGraphNode struct {
+	Addr     uint
+	Name     string // label, variable or OS call at Addr, if there is one
+	Size     uint   // bytes up to the next subroutine or the end of the program
+	Calls    int    // number of JSRs to the subroutine
+	OSCall   bool   // a BBC Micro OS call
+	External bool   // outside the program, Size is zero
+}
+
+// CallGraphEdge is one subroutine calling or jumping to another. Count is
+// the number of JSR or JMP instructions doing so.
+type CallGraphEdge struct {
+	From  uint // address of the calling node
+	To    uint // address of the node called
+	Jump  bool // a JMP, otherwise a JSR
+	Count int
+}
+
+// CallGraph is the graph of the subroutines of a program and the calls and
+// jumps between them
+type CallGraph struct {
+	Nodes []CallGraphNode // sorted by address
+	Edges []CallGraphEdge // sorted by From, To and then JSRs before JMPs
+}
+
+// CallGraph returns the call graph of the last disassembly. Each instruction
+// belongs to the subroutine starting at or before it, with the bytes before
+// the first subroutine belonging to the start of the program. A JMP is an
+// edge to the subroutine containing its target, unless that is the one
+// containing the JMP. Indirect jumps are not followed.
+func (d *Disassembler) CallGraph() CallGraph {
+	start := d.BranchAdjust + d.Offset
+	end := start + d.MaxBytes
+	inProgram := func(addr uint) bool { return addr >= start && addr < end }
+
+	nodes := map[uint]*CallGraphNode{start: {Addr: start}}
+	xrefs := d.XRefs()
+	for _, x := range xrefs {
+		if x.Access == AccessCall || (x.Access == AccessJump && !inProgram(x.Addr)) {
+			if nodes[x.Addr] == nil {
+				nodes[x.Addr] = &CallGraphNode{Addr: x.Addr}
+			}
+		}
+		if x.Access == AccessCall {
+			nodes[x.Addr].Calls++
+		}
+	}
+
+	// Subroutines in the program in order, to find the one holding an address
+	var subs []uint
+	for addr, n := range nodes {
+		if inProgram(addr) {
+			subs = append(subs, addr)
+		} else {
+			n.External = true
+		}
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i] < subs[j] })
+	for i, addr := range subs {
+		next := end
+		if i+1 < len(subs) {
+			next = subs[i+1]
+		}
+		nodes[addr].Size = next - addr
+	}
+	containing := func(addr uint) uint {
+		i := sort.Search(len(subs), func(i int) bool { return subs[i] > addr })
+		return subs[i-1]
+	}
+
+	type edgeKey struct {
+		from, to uint
+		jump     bool
+	}
+	edges := make(map[edgeKey]int)
+	for _, x := range xrefs {
+		if x.Access != AccessCall && x.Access != AccessJump {
+			continue
+		}
+		from, to := containing(x.From), x.Addr
+		if nodes[to] == nil {
+			if to = containing(x.Addr); to == from {
+				continue
+			}
+		}
+		edges[edgeKey{from, to, x.Access == AccessJump}]++
+	}
+
+	var g CallGraph
+	for addr, n := range nodes {
+		if osCall, ok := addressToOsCallName[addr]; ok && n.External {
+			n.Name, n.OSCall = osCall, true
+		} else if name, ok := d.addrName(addr); ok {
+			n.Name = name
+		}
+		g.Nodes = append(g.Nodes, *n)
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool { return g.Nodes[i].Addr < g.Nodes[j].Addr })
+	for k, count := range edges {
+		g.Edges = append(g.Edges, CallGraphEdge{k.from, k.to, k.jump, count})
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		a, b := g.Edges[i], g.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return !a.Jump && b.Jump
+	})
+	return g
+}
+
+// WriteDOT writes the call graph in the Graphviz DOT language. Subroutines
+// are labelled with their name, address, size and the number of calls to
+// them, OS calls are shaded and other addresses outside the program dashed.
+// JMP edges are dashed and edges taken by more than one instruction are
+// labelled with the count.
+func (g CallGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph callgraph {")
+	fmt.Fprintln(bw, `  node [shape=box, fontname="monospace"];`)
+	for _, n := range g.Nodes {
+		attrs := ""
+		switch {
+		case n.OSCall:
+			attrs = `, shape=ellipse, style=filled, fillcolor="#dde8f8"`
+		case n.External:
+			attrs = ", style=dashed"
+		}
+		label := fmt.Sprintf("&%04X", n.Addr)
+		if n.Name != "" {
+			label = n.Name + `\n` + label
+		}
+		if !n.External {
+			label += fmt.Sprintf(`, %d bytes`, n.Size)
+		}
+		switch {
+		case n.Calls == 1:
+			label += `\ncalled once`
+		case n.Calls > 1:
+			label += fmt.Sprintf(`\ncalled %d times`, n.Calls)
+		}
+		fmt.Fprintf(bw, "  n%04X [label=\"%s\"%s];\n", n.Addr, label, attrs)
+	}
+	for _, e := range g.Edges {
+		var attrs []string
+		if e.Jump {
+			attrs = append(attrs, "style=dashed")
+		}
+		if e.Count > 1 {
+			attrs = append(attrs, fmt.Sprintf(`label="%d"`, e.Count))
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(bw, "  n%04X -> n%04X [%s];\n", e.From, e.To, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(bw, "  n%04X -> n%04X;\n", e.From, e.To)
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
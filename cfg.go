@@ -0,0 +1,316 @@
+package bbcdisasm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// EdgeKind is how control passes from one basic block to another
+type EdgeKind int
+
+// Edge kinds
+//  EdgeFallThrough - into the next block, after a branch not taken or
+//                    because the next instruction is a branch target
+//  EdgeBranch      - a branch taken
+//  EdgeJump        - a JMP
+const (
+	EdgeFallThrough EdgeKind = iota
+	EdgeBranch
+	EdgeJump
+)
+
+var edgeKindNames = []string{"fallthrough", "branch", "jump"}
+
+func (k EdgeKind) String() string {
+	if int(k) < len(edgeKindNames) {
+		return edgeKindNames[k]
+	}
+	return fmt.Sprintf("EdgeKind(%d)", int(k))
+}
+
+// MarshalText encodes the kind as its name
+func (k EdgeKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// CFGEdge is an edge of a control flow graph. External edges go to an
+// address that is not the start of a block of the subroutine, usually in
+// another subroutine.
+type CFGEdge struct {
+	To       uint
+	Kind     EdgeKind
+	External bool
+}
+
+// BasicBlock is a run of instructions entered only at the first and left
+// only after the last
+type BasicBlock struct {
+	Start        uint // address of the first instruction
+	End          uint // address after the last instruction
+	Instructions []Instruction
+	Text         []string // the instructions as written
+	Edges        []CFGEdge
+
+	// Unreachable blocks cannot be reached from the entry of the subroutine
+	// and FallsIntoData blocks run on into bytes that are not an instruction,
+	// a data region or the end of the program. Both are signs the
+	// disassembly has lost track of the instructions.
+	Unreachable   bool
+	FallsIntoData bool
+}
+
+// ControlFlowGraph is the graph of the basic blocks of a subroutine, a node
+// of the CallGraph in the program. Blocks are sorted by address, the first
+// being the entry unless the disassembly has no instruction there.
+type ControlFlowGraph struct {
+	Entry  uint
+	Name   string
+	Blocks []BasicBlock
+}
+
+// ControlFlowGraphs returns the control flow graph of each subroutine of the
+// last disassembly. Blocks start at the subroutine entry, at the targets of
+// branches and jumps and after branches, jumps, returns, BRK and KIL, and
+// at instructions following bytes that are not one. Instructions written as
+// data because the assembler does not support them are included.
+func (d *Disassembler) ControlFlowGraphs() []ControlFlowGraph {
+	// The instructions in the program in order
+	var ins []Instruction
+	d.walk(vtCode, func(_, _ uint, in Instruction, err error) int {
+		if err != nil {
+			return 1
+		}
+		ins = append(ins, in)
+		return int(in.Length())
+	}, nil)
+	index := make(map[uint]int)
+	for i, in := range ins {
+		index[in.Address] = i
+	}
+
+	var cfgs []ControlFlowGraph
+	for _, n := range d.CallGraph().Nodes {
+		if n.External {
+			continue
+		}
+		first := sort.Search(len(ins), func(i int) bool { return ins[i].Address >= n.Addr })
+		last := sort.Search(len(ins), func(i int) bool { return ins[i].Address >= n.Addr+n.Size })
+		cfgs = append(cfgs, d.controlFlowGraph(n, ins[first:last], index))
+	}
+	return cfgs
+}
+
+// controlFlowGraph splits the instructions of a subroutine into blocks
+func (d *Disassembler) controlFlowGraph(n CallGraphNode, ins []Instruction, index map[uint]int) ControlFlowGraph {
+	cfg := ControlFlowGraph{Entry: n.Addr, Name: n.Name}
+	inSub := func(addr uint) bool { return addr >= n.Addr && addr < n.Addr+n.Size }
+
+	leaders := map[uint]bool{n.Addr: true}
+	for i, in := range ins {
+		if i > 0 && ins[i-1].Next() != in.Address {
+			leaders[in.Address] = true
+		}
+		if (in.Branch || in.Jump) && in.HasTarget && inSub(in.Target) {
+			leaders[in.Target] = true
+		}
+		if endsBlock(in) {
+			leaders[in.Next()] = true
+		}
+	}
+
+	for i, in := range ins {
+		if leaders[in.Address] || i == 0 {
+			cfg.Blocks = append(cfg.Blocks, BasicBlock{Start: in.Address})
+		}
+		b := &cfg.Blocks[len(cfg.Blocks)-1]
+		b.Instructions = append(b.Instructions, in)
+		b.Text = append(b.Text, strings.TrimSpace(in.Opcode.Name+" "+d.operandText(in)))
+		b.End = in.Next()
+	}
+
+	starts := make(map[uint]int)
+	for i, b := range cfg.Blocks {
+		starts[b.Start] = i
+	}
+	edge := func(b *BasicBlock, to uint, kind EdgeKind) {
+		_, ok := starts[to]
+		b.Edges = append(b.Edges, CFGEdge{to, kind, !ok || !inSub(to)})
+	}
+	for i := range cfg.Blocks {
+		b := &cfg.Blocks[i]
+		in := b.Instructions[len(b.Instructions)-1]
+		fallsThrough := true
+		switch {
+		case in.Branch:
+			edge(b, in.Target, EdgeBranch)
+			fallsThrough = in.Opcode.Name != "BRA"
+		case in.Jump:
+			if in.HasTarget {
+				edge(b, in.Target, EdgeJump)
+			}
+			fallsThrough = false
+		case endsBlock(in):
+			fallsThrough = false
+		}
+		if !fallsThrough {
+			continue
+		}
+		if _, ok := index[b.End]; ok {
+			edge(b, b.End, EdgeFallThrough)
+		} else {
+			b.FallsIntoData = true
+		}
+	}
+
+	// Blocks are reachable from the entry along the edges inside the
+	// subroutine
+	reached := make(map[int]bool)
+	var visit func(i int)
+	visit = func(i int) {
+		if reached[i] {
+			return
+		}
+		reached[i] = true
+		for _, e := range cfg.Blocks[i].Edges {
+			if !e.External {
+				visit(starts[e.To])
+			}
+		}
+	}
+	if len(cfg.Blocks) > 0 {
+		visit(0)
+	}
+	for i := range cfg.Blocks {
+		cfg.Blocks[i].Unreachable = !reached[i]
+	}
+	return cfg
+}
+
+// endsBlock is true if the instruction following in does not run after it,
+// or may not
+func endsBlock(in Instruction) bool {
+	return in.Branch || in.Jump || in.Return || in.Opcode.Name == "BRK" || in.Opcode.Stability == Jam
+}
+
+// WriteDOT writes the control flow graph in the Graphviz DOT language. Each
+// block is labelled with its instructions. Unreachable blocks are shaded,
+// blocks falling into data outlined in red and edges leaving the subroutine
+// go to dashed nodes. Taken branches are green and jumps dashed.
+func (cfg ControlFlowGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph %q {\n", cfg.title())
+	fmt.Fprintln(bw, `  node [shape=box, fontname="monospace"];`)
+	external := make(map[uint]bool)
+	for _, b := range cfg.Blocks {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, `<b>&amp;%04X</b><br align="left"/>`, b.Start)
+		for i, text := range b.Text {
+			fmt.Fprintf(&sb, `&amp;%04X  %s<br align="left"/>`, b.Instructions[i].Address, html.EscapeString(text))
+		}
+		if b.FallsIntoData {
+			sb.WriteString(`<i>falls into data</i><br align="left"/>`)
+		}
+		attrs := ""
+		if b.Unreachable {
+			attrs += `, style=filled, fillcolor="#dddddd"`
+		}
+		if b.FallsIntoData {
+			attrs += ", color=red"
+		}
+		fmt.Fprintf(bw, "  b%04X [label=<%s>%s];\n", b.Start, sb.String(), attrs)
+		for _, e := range b.Edges {
+			if e.External && !external[e.To] {
+				external[e.To] = true
+				fmt.Fprintf(bw, "  x%04X [label=\"&%04X\", style=dashed];\n", e.To, e.To)
+			}
+		}
+	}
+	for _, b := range cfg.Blocks {
+		for _, e := range b.Edges {
+			to := fmt.Sprintf("b%04X", e.To)
+			if e.External {
+				to = fmt.Sprintf("x%04X", e.To)
+			}
+			switch e.Kind {
+			case EdgeBranch:
+				fmt.Fprintf(bw, "  b%04X -> %s [color=darkgreen];\n", b.Start, to)
+			case EdgeJump:
+				fmt.Fprintf(bw, "  b%04X -> %s [style=dashed];\n", b.Start, to)
+			default:
+				fmt.Fprintf(bw, "  b%04X -> %s;\n", b.Start, to)
+			}
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// title returns the name of the subroutine, or its address if it has none
+func (cfg ControlFlowGraph) title() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return fmt.Sprintf("&%04X", cfg.Entry)
+}
+
+type jsonCFG struct {
+	Entry  uint        `json:"entry"`
+	Name   string      `json:"name,omitempty"`
+	Blocks []jsonBlock `json:"blocks"`
+}
+
+type jsonBlock struct {
+	Start         uint              `json:"start"`
+	End           uint              `json:"end"`
+	Instructions  []jsonInstruction `json:"instructions"`
+	Edges         []jsonEdge        `json:"edges"`
+	Unreachable   bool              `json:"unreachable"`
+	FallsIntoData bool              `json:"falls_into_data"`
+}
+
+type jsonInstruction struct {
+	Address uint   `json:"address"`
+	Text    string `json:"text"`
+}
+
+type jsonEdge struct {
+	To       uint     `json:"to"`
+	Kind     EdgeKind `json:"kind"`
+	External bool     `json:"external"`
+}
+
+// WriteJSON writes the control flow graph as a JSON object with the entry
+// address, the name if there is one and the blocks. Each block has the
+// start and end (exclusive) addresses, the instructions with their address
+// and text, the edges with the address they go to, their kind and whether
+// they leave the subroutine, and the unreachable and falls_into_data flags.
+func (cfg ControlFlowGraph) WriteJSON(w io.Writer) error {
+	out := jsonCFG{Entry: cfg.Entry, Name: cfg.Name, Blocks: []jsonBlock{}}
+	for _, b := range cfg.Blocks {
+		jb := jsonBlock{
+			Start:         b.Start,
+			End:           b.End,
+			Instructions:  []jsonInstruction{},
+			Edges:         []jsonEdge{},
+			Unreachable:   b.Unreachable,
+			FallsIntoData: b.FallsIntoData,
+		}
+		for i, in := range b.Instructions {
+			jb.Instructions = append(jb.Instructions, jsonInstruction{in.Address, b.Text[i]})
+		}
+		for _, e := range b.Edges {
+			jb.Edges = append(jb.Edges, jsonEdge{e.To, e.Kind, e.External})
+		}
+		out.Blocks = append(out.Blocks, jb)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bbcdisasm"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+func asmCmd(c *cli.Context) error {
+	if c.Args().Len() < 1 {
+		return cli.Exit("Insufficient arguments", 1)
+	}
+
+	as := bbcdisasm.NewAssembler()
+	as.Output = c.String("output")
+	asm, err := as.AssembleFile(c.Args().First())
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	if len(asm.Files) == 0 {
+		fmt.Fprintln(os.Stderr, "No files saved, use SAVE in the source")
+		return nil
+	}
+
+	if disk := c.String("disk"); disk != "" {
+		if err := writeDisk(disk, c.String("title"), c.Int("opt"), asm.Files); err != nil {
+			return cli.Exit(err, 1)
+		}
+		return nil
+	}
+	for _, f := range asm.Files {
+		if err := ioutil.WriteFile(filepath.Join(c.String("outdir"), f.Name), f.Data, 0644); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	return nil
+}
+
+// writeDisk writes the files to a new DFS disk image. A file name may start
+// with a directory, e.g. B.PROG.
+func writeDisk(file, title string, bootOpt int, files []bbcdisasm.AssembledFile) error {
+	img := &bbcdisasm.DiskImage{Title: title, BootOpt: bootOpt}
+	var contents [][]byte
+	for _, f := range files {
+		dir, name := "$", f.Name
+		if len(name) > 2 && name[1] == '.' {
+			dir, name = name[:1], name[2:]
+		}
+		img.Files = append(img.Files, bbcdisasm.Catalog{
+			Filename: name,
+			Dir:      dir,
+			LoadAddr: int(f.Load),
+			ExecAddr: int(f.Exec),
+		})
+		contents = append(contents, f.Data)
+	}
+
+	data, err := bbcdisasm.BuildDFS(img, contents)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bbcdisasm"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -12,28 +15,432 @@ import (
 )
 
 func disasmCmd(c *cli.Context) error {
-	args := c.Args()
+	var disasm *bbcdisasm.Disassembler
+	var err error
+	project := c.String("project")
+	if project != "" {
+		if disasm, err = disassemblerForProject(project); err != nil {
+			return cli.Exit(err, 1)
+		}
+	} else if disasm, err = disassemblerForArgs(c.Args()); err != nil {
+		return err
+	}
+
+	// Command line options override the project
+	if project == "" || c.IsSet("loadaddr") {
+		disasm.BranchAdjust = uint(c.Int("loadaddr"))
+	}
+	if project == "" || c.IsSet("cpu") {
+		if disasm.CPU, err = bbcdisasm.ParseCPU(c.String("cpu")); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if project == "" || c.IsSet("dialect") {
+		if disasm.Dialect, err = bbcdisasm.ParseDialect(c.String("dialect")); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if project == "" || c.IsSet("xrefs") {
+		if disasm.CrossReferences, err = bbcdisasm.ParseXRefStyle(c.String("xrefs")); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if c.Bool("verify") && disasm.Dialect != bbcdisasm.Beebasm {
+		return cli.Exit("--verify needs the beebasm dialect", 1)
+	}
+	if c.Bool("verify") && c.String("format") != "text" {
+		return cli.Exit("--verify needs text output", 1)
+	}
+
+	caddrs := c.String("codeaddrs")
+	if len(caddrs) > 0 {
+		saddrs := strings.Split(caddrs, ",")
+		for _, addr := range saddrs {
+			i, err := strconv.ParseInt(addr, 0, 64)
+			if err != nil {
+				return cli.Exit("Could not parse address", 1)
+			}
+			if i < 0 {
+				return cli.Exit("Invalid address", 1)
+			}
+			disasm.CodeAddrs = append(disasm.CodeAddrs, uint(i))
+		}
+	}
+
+	if c.Bool("strings") && disasm.Strings == nil {
+		disasm.Strings = &bbcdisasm.StringDetector{}
+	}
+	if disasm.Strings != nil && (project == "" || c.IsSet("string-min")) {
+		disasm.Strings.MinLength = c.Int("string-min")
+	}
+	if disasm.Strings != nil && (project == "" || c.IsSet("string-chars")) {
+		charset, err := bbcdisasm.ParseCharset(c.String("string-chars"))
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		disasm.Strings.Charset = charset
+	}
+
+	for _, inline := range c.StringSlice("inline") {
+		if err := addInline(disasm, inline); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if c.Bool("detect-inline") {
+		disasm.DetectInline = true
+	}
+	for _, indirect := range c.StringSlice("indirect") {
+		if err := addIndirect(disasm, indirect); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if c.Bool("resolve-indirect") {
+		disasm.ResolveIndirect = true
+	}
+	if c.Bool("tables") {
+		disasm.Tables = true
+	}
+	if c.Bool("subroutines") {
+		disasm.Subroutines = true
+	}
+
+	for _, region := range c.StringSlice("region") {
+		if err := addRegion(disasm, region); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	for _, symfile := range c.StringSlice("symbols") {
+		syms, err := readSymbols(symfile)
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("%s: %v", symfile, err), 1)
+		}
+		disasm.AddSymbols(syms)
+	}
+
+	for _, commentfile := range c.StringSlice("comments") {
+		if err := addComments(disasm, commentfile); err != nil {
+			return cli.Exit(fmt.Sprintf("%s: %v", commentfile, err), 1)
+		}
+	}
+
+	dvars := c.StringSlice("definevar")
+	for _, dvar := range dvars {
+		parts := strings.Split(dvar, "=")
+		if len(parts) <= 1 {
+			return cli.Exit(fmt.Sprintf("invalid variable definition %q", dvar), 1)
+		}
+		err := disasm.AddVar(parts[0], parts[1])
+		if err != nil {
+			return cli.Exit(fmt.Sprintf("non numeric value %q", parts[1]), 1)
+		}
+	}
+
+	switch format := c.String("format"); {
+	case format == "html":
+		title := project
+		if title == "" {
+			title = c.Args().First()
+		}
+		if err := disasm.WriteHTML(os.Stdout, filepath.Base(title)); err != nil {
+			return cli.Exit(err, 1)
+		}
+	case format == "json":
+		if err := disasm.WriteJSON(os.Stdout); err != nil {
+			return cli.Exit(err, 1)
+		}
+	case format != "text":
+		return cli.Exit(fmt.Sprintf("unknown output format %q", format), 1)
+	case c.Bool("verify"):
+		if err := disassembleAndVerify(disasm); err != nil {
+			return cli.Exit(err, 1)
+		}
+	default:
+		if err := disasm.Disassemble(os.Stdout); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+
+	if symfile := c.String("export-symbols"); symfile != "" {
+		if err := exportSymbols(disasm, symfile, c.String("export-format")); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if dotfile := c.String("callgraph"); dotfile != "" {
+		if err := exportCallGraph(disasm, dotfile); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	if dir := c.String("cfg"); dir != "" {
+		if err := exportCFGs(disasm, dir); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	return nil
+}
+
+// disassembleAndVerify writes the disassembly to stdout then reassembles it,
+// reporting the bytes that differ from the program on stderr
+func disassembleAndVerify(disasm *bbcdisasm.Disassembler) error {
+	var buf bytes.Buffer
+	if err := disasm.Disassemble(&buf); err != nil {
+		return err
+	}
+	if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	diffs, err := disasm.Verify(&buf)
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+	for _, diff := range diffs {
+		fmt.Fprintf(os.Stderr, "verify: %v\n", diff)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("verify: %d bytes differ from the program", len(diffs))
+	}
+	fmt.Fprintf(os.Stderr, "verify: &%X bytes reassembled identically\n", disasm.MaxBytes)
+	return nil
+}
+
+// exportSymbols writes the symbol table of the disassembly to file. If format
+// is empty then it is chosen from the file extension.
+func exportSymbols(disasm *bbcdisasm.Disassembler, file, format string) error {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".json":
+			format = "json"
+		case ".lbl", ".vs", ".sym":
+			format = "vice"
+		default:
+			format = "beebasm"
+		}
+	}
+
+	var write func(io.Writer, []bbcdisasm.Symbol) error
+	switch format {
+	case "vice":
+		write = bbcdisasm.WriteVICESymbols
+	case "beebasm":
+		write = bbcdisasm.WriteBeebasmSymbols
+	case "json":
+		write = bbcdisasm.WriteJSONSymbols
+	default:
+		return fmt.Errorf("unknown symbol format %q", format)
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := write(f, disasm.Symbols()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportCallGraph writes the call graph of the disassembly to file in DOT
+// format
+func exportCallGraph(disasm *bbcdisasm.Disassembler, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := disasm.CallGraph().WriteDOT(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// exportCFGs writes the control flow graph of each subroutine to dir in DOT
+// and JSON, reporting the blocks that suggest the disassembly lost track of
+// the instructions on stderr
+func exportCFGs(disasm *bbcdisasm.Disassembler, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	cfgs := disasm.ControlFlowGraphs()
+	var unreachable, intoData int
+	for _, cfg := range cfgs {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("%04X", cfg.Entry)
+		}
+		for _, b := range cfg.Blocks {
+			if b.Unreachable {
+				unreachable++
+			}
+			if b.FallsIntoData {
+				intoData++
+			}
+		}
+		if err := writeFile(filepath.Join(dir, name+".dot"), cfg.WriteDOT); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, name+".json"), cfg.WriteJSON); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "cfg: %d subroutines, %d unreachable blocks, %d blocks falling into data\n", len(cfgs), unreachable, intoData)
+	return nil
+}
+
+// writeFile creates file and writes it with write
+func writeFile(file string, write func(io.Writer) error) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// addRegion parses a region definition of the form <start>-<end>=<type> and
+// marks it on the disassembler. The end address is exclusive.
+func addRegion(disasm *bbcdisasm.Disassembler, region string) error {
+	parts := strings.Split(region, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid region definition %q", region)
+	}
+	tparts := strings.Split(parts[1], "@")
+	rtype, err := bbcdisasm.ParseRegionType(tparts[0])
+	if err != nil {
+		return err
+	}
+	var partner uint64
+	if rtype == bbcdisasm.RegionPointersLo || rtype == bbcdisasm.RegionPointersHi {
+		if len(tparts) != 2 {
+			return fmt.Errorf("region %q needs the address of the other table, e.g. %s@0x3100", region, tparts[0])
+		}
+		if partner, err = strconv.ParseUint(tparts[1], 0, 16); err != nil {
+			return fmt.Errorf("could not parse table address %q", tparts[1])
+		}
+	} else if len(tparts) != 1 {
+		return fmt.Errorf("invalid region type %q", parts[1])
+	}
+	addrs := strings.Split(parts[0], "-")
+	if len(addrs) != 2 {
+		return fmt.Errorf("invalid region range %q", parts[0])
+	}
+	start, err := strconv.ParseUint(addrs[0], 0, 16)
+	if err != nil {
+		return fmt.Errorf("could not parse region start %q", addrs[0])
+	}
+	end, err := strconv.ParseUint(addrs[1], 0, 17)
+	if err != nil {
+		return fmt.Errorf("could not parse region end %q", addrs[1])
+	}
+	if end <= start {
+		return fmt.Errorf("region %q is empty", region)
+	}
+
+	switch rtype {
+	case bbcdisasm.RegionPointersLo:
+		disasm.Regions.MarkSplit(uint(start), uint(partner), uint(end-start))
+	case bbcdisasm.RegionPointersHi:
+		disasm.Regions.MarkSplit(uint(partner), uint(start), uint(end-start))
+	default:
+		disasm.Regions.Mark(uint(start), uint(end), rtype)
+	}
+	return nil
+}
+
+// addInline declares a subroutine taking inline data, <addr>=<data>
+func addInline(disasm *bbcdisasm.Disassembler, inline string) error {
+	parts := strings.Split(inline, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid inline data definition %q", inline)
+	}
+	addr, err := strconv.ParseUint(parts[0], 0, 16)
+	if err != nil {
+		return fmt.Errorf("could not parse subroutine address %q", parts[0])
+	}
+	id, err := bbcdisasm.ParseInlineData(parts[1])
+	if err != nil {
+		return err
+	}
+	disasm.Inline[uint(addr)] = id
+	return nil
+}
+
+// addIndirect declares the targets of an indirect jump,
+// <addr>=<target>:<target>...
+func addIndirect(disasm *bbcdisasm.Disassembler, indirect string) error {
+	parts := strings.Split(indirect, "=")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid indirect jump definition %q", indirect)
+	}
+	addr, err := strconv.ParseUint(parts[0], 0, 16)
+	if err != nil {
+		return fmt.Errorf("could not parse jump address %q", parts[0])
+	}
+	for _, t := range strings.Split(parts[1], ":") {
+		target, err := strconv.ParseUint(t, 0, 16)
+		if err != nil {
+			return fmt.Errorf("could not parse jump target %q", t)
+		}
+		disasm.IndirectTargets[uint(addr)] = append(disasm.IndirectTargets[uint(addr)], uint(target))
+	}
+	return nil
+}
+
+func readSymbols(file string) ([]bbcdisasm.Symbol, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return bbcdisasm.ParseSymbols(f)
+}
+
+// addComments loads a comments file into the disassembler, see
+// bbcdisasm.ParseComments.
+func addComments(disasm *bbcdisasm.Disassembler, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	inline, block, err := bbcdisasm.ParseComments(f)
+	if err != nil {
+		return err
+	}
+	disasm.AddComments(inline, block)
+	return nil
+}
+
+// disassemblerForArgs creates a disassembler from the command line arguments
+// file [offset] [length]
+func disassemblerForArgs(args cli.Args) (*bbcdisasm.Disassembler, error) {
 	if args.Len() < 1 {
-		return cli.Exit("Insufficient arguments", 1)
+		return nil, cli.Exit("Insufficient arguments", 1)
 	}
 	file := args.First()
 
 	fileLen, err := fileLength(file)
 	if err != nil {
-		return cli.Exit(err, 1)
+		return nil, cli.Exit(err, 1)
 	}
 
 	// Is there an offset from program start for disassembly to begin?
 	var offset int64
 	if args.Len() >= 2 {
 		if offset, err = strconv.ParseInt(args.Get(1), 0, 64); err != nil {
-			return cli.Exit("Could not parse offset", 1)
+			return nil, cli.Exit("Could not parse offset", 1)
 		}
 		if offset < 0 {
-			return cli.Exit("offset cannot be before start of file", 1)
+			return nil, cli.Exit("offset cannot be before start of file", 1)
 		}
 		if offset >= fileLen {
-			return cli.Exit("offset cannot be past end of file", 1)
+			return nil, cli.Exit("offset cannot be past end of file", 1)
 		}
 	}
 
@@ -41,53 +448,79 @@ func disasmCmd(c *cli.Context) error {
 	length := fileLen - offset
 	if args.Len() >= 3 {
 		if length, err = strconv.ParseInt(args.Get(2), 0, 64); err != nil {
-			return cli.Exit("Could not parse length", 1)
+			return nil, cli.Exit("Could not parse length", 1)
 		}
 		if length < 0 {
-			return cli.Exit("length cannot be negative", 1)
+			return nil, cli.Exit("length cannot be negative", 1)
 		}
-		if length > fileLen {
-			length = fileLen
+		if length > fileLen-offset {
+			length = fileLen - offset
 		}
 	}
 
 	disasm, err := disassemblerForFile(file)
 	if err != nil {
-		return cli.Exit(err, 1)
+		return nil, cli.Exit(err, 1)
 	}
 	disasm.MaxBytes = uint(length)
 	disasm.Offset = uint(offset)
-	disasm.BranchAdjust = uint(c.Int("loadaddr"))
+	return disasm, nil
+}
 
-	caddrs := c.String("codeaddrs")
-	if len(caddrs) > 0 {
-		saddrs := strings.Split(caddrs, ",")
-		for _, addr := range saddrs {
-			i, err := strconv.ParseInt(addr, 0, 64)
-			if err != nil {
-				return cli.Exit("Could not parse address", 1)
-			}
-			if i < 0 {
-				return cli.Exit("Invalid address", 1)
-			}
-			disasm.CodeAddrs = append(disasm.CodeAddrs, uint(i))
-		}
+// disassemblerForProject creates a disassembler configured by a project file,
+// loading the program and symbol files it names.
+func disassemblerForProject(file string) (*bbcdisasm.Disassembler, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
 	}
+	defer f.Close()
 
-	dvars := c.StringSlice("definevar")
-	for _, dvar := range dvars {
-		parts := strings.Split(dvar, "=")
-		if len(parts) <= 1 {
-			return cli.Exit(fmt.Sprintf("invalid variable definition %q", dvar), 1)
+	project, err := bbcdisasm.LoadProject(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	// Paths in the project are relative to the project file
+	dir := filepath.Dir(file)
+
+	var program []byte
+	if project.Source != "" {
+		if program, err = ioutil.ReadFile(filepath.Join(dir, project.Source)); err != nil {
+			return nil, err
 		}
-		err := disasm.AddVar(parts[0], parts[1])
+	} else {
+		data, err := ioutil.ReadFile(filepath.Join(dir, project.Disk))
 		if err != nil {
-			return cli.Exit(fmt.Sprintf("non numeric value %q", parts[1]), 1)
+			return nil, err
+		}
+		entry, ok := bbcdisasm.ParseDFS(data).Find(project.Entry)
+		if !ok {
+			return nil, fmt.Errorf("%s not found in %s", project.Entry, project.Disk)
+		}
+		if program, err = entry.Contents(data); err != nil {
+			return nil, err
+		}
+		if project.LoadAddr == nil {
+			loadAddr := bbcdisasm.Address(entry.LoadAddr & 0xFFFF)
+			project.LoadAddr = &loadAddr
 		}
 	}
 
-	disasm.Disassemble(os.Stdout)
-	return nil
+	disasm, err := bbcdisasm.NewDisassemblerFromProject(project, program)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, symfile := range project.Symbols {
+		syms, err := readSymbols(filepath.Join(dir, symfile))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", symfile, err)
+		}
+		disasm.AddSymbols(syms)
+	}
+
+	return disasm, nil
 }
 
 func disassemblerForFile(file string) (*bbcdisasm.Disassembler, error) {
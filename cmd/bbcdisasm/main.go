@@ -68,8 +68,10 @@ func extractFromDfs(file string, entries []string, outDir string) error {
 	for _, f := range img.Files {
 		if len(entries) == 0 || em[f.Filename] {
 			// Retrieve data contents
-			offset := f.StartSector * 256
-			d := data[offset:(offset + f.Length)]
+			d, err := f.Contents(data)
+			if err != nil {
+				return err
+			}
 
 			ofn := path.Join(outDir, f.Filename)
 			if err := ioutil.WriteFile(ofn, d, 0644); err != nil {
@@ -142,17 +144,111 @@ func main() {
 			Name:      "disasm",
 			Aliases:   []string{"d"},
 			Usage:     "Disassemble a file",
-			ArgsUsage: "file [offset] [length]",
+			ArgsUsage: "[--project project.json] file [offset] [length]",
 			Action:    disasmCmd,
 			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "project",
+					Usage: "project file holding the program and its annotations",
+				},
 				&cli.IntFlag{
 					Name:  "loadaddr",
 					Usage: "load address for the code",
 				},
+				&cli.StringFlag{
+					Name:  "cpu",
+					Value: "6502",
+					Usage: "CPU variant, one of 6502, 65c02 or r65c02",
+				},
+				&cli.StringFlag{
+					Name:  "dialect",
+					Value: "beebasm",
+					Usage: "assembler syntax of the output, one of beebasm, ca65, acme, 64tass, ophis or basic",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "output format, text, html, a single page with the labels and symbols linked, or json, the disassembly model",
+				},
+				&cli.StringFlag{
+					Name:  "xrefs",
+					Value: "none",
+					Usage: "cross references, none, labels for a comment on each label or table for a table after the program",
+				},
 				&cli.StringFlag{
 					Name:  "codeaddrs",
 					Usage: "locations of known code",
 				},
+				&cli.StringSliceFlag{
+					Name:  "region",
+					Usage: "<start>-<end>=<type>, mark addresses start up to end as code, bytes, words, string, pointers or unknown. pointers-lo@<addr> and pointers-hi@<addr> mark split tables",
+				},
+				&cli.StringSliceFlag{
+					Name:  "inline",
+					Usage: "<addr>=<data>, the subroutine at addr is followed by data: a length, or a string terminated by zero, cr or highbit",
+				},
+				&cli.BoolFlag{
+					Name:  "detect-inline",
+					Usage: "detect subroutines followed by inline data",
+				},
+				&cli.StringSliceFlag{
+					Name:  "indirect",
+					Usage: "<addr>=<target>:<target>..., the targets of the indirect jump at addr",
+				},
+				&cli.BoolFlag{
+					Name:  "resolve-indirect",
+					Usage: "find the targets of indirect jumps from the program",
+				},
+				&cli.BoolFlag{
+					Name:  "tables",
+					Usage: "detect tables of addresses and emit them with EQUW or LO() and HI()",
+				},
+				&cli.BoolFlag{
+					Name:  "subroutines",
+					Usage: "name the targets of JSR sub_XXXX, with a header comment and local labels",
+				},
+				&cli.BoolFlag{
+					Name:  "strings",
+					Usage: "detect strings and emit them with EQUS",
+				},
+				&cli.IntFlag{
+					Name:  "string-min",
+					Value: bbcdisasm.DefaultStringMinLength,
+					Usage: "minimum length of a detected string",
+				},
+				&cli.StringFlag{
+					Name:  "string-chars",
+					Value: "printable",
+					Usage: "characters allowed in a detected string, printable, text or a list like A-Z0-9",
+				},
+				&cli.StringSliceFlag{
+					Name:  "symbols",
+					Usage: "symbol file in beebasm -d, VICE, ca65 .dbg/.lbl or name = &XXXX format",
+				},
+				&cli.StringSliceFlag{
+					Name:  "comments",
+					Usage: "file of inline and block comments keyed by address",
+				},
+				&cli.BoolFlag{
+					Name:  "verify",
+					Usage: "reassemble the disassembly, which must be beebasm, and report any byte that differs from the program",
+				},
+				&cli.StringFlag{
+					Name:  "export-symbols",
+					Usage: "write the symbol table of the disassembly to a file",
+				},
+				&cli.StringFlag{
+					Name:  "callgraph",
+					Usage: "write the call graph of the subroutines to a file in Graphviz DOT format",
+				},
+				&cli.StringFlag{
+					Name:  "cfg",
+					Usage: "write the control flow graph of each subroutine to a directory, as <name>.dot and <name>.json",
+				},
+				&cli.StringFlag{
+					Name:  "export-format",
+					Usage: "symbol export format, one of vice, beebasm or json. Chosen from the file extension by default",
+				},
 				&cli.StringSliceFlag{
 					Name:    "definevar",
 					Usage:   "<variable>=<value>",
@@ -160,6 +256,37 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:      "asm",
+			Aliases:   []string{"a"},
+			Usage:     "Assemble beebasm source, writing the files it saves",
+			ArgsUsage: "[--disk image.ssd] source",
+			Action:    asmCmd,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "outdir",
+					Value: ".",
+					Usage: "output directory for the saved files",
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "name of the file saved by SAVE without a file name",
+				},
+				&cli.StringFlag{
+					Name:  "disk",
+					Usage: "write the saved files to a new DFS disk image instead",
+				},
+				&cli.StringFlag{
+					Name:  "title",
+					Usage: "title of the disk image",
+				},
+				&cli.IntFlag{
+					Name:  "opt",
+					Usage: "boot option of the disk image, as set by *OPT 4,n",
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,94 @@
+package bbcdisasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ParseComments reads user comments keyed by address. Each line holds an
+// address followed by an inline comment, which is appended to the line
+// disassembling the address. An address followed by { starts a block
+// comment, printed above the address, which runs until a line holding only }.
+// Lines starting with # are ignored.
+//
+//  # Comments for EXILE
+//  &4A10 Select screen mode
+//  &4A3A {
+//  Clear the object table
+//    Y counts down from 15
+//  }
+func ParseComments(r io.Reader) (inline, block map[uint]string, err error) {
+	inline = make(map[uint]string)
+	block = make(map[uint]string)
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	var blockAddr uint
+	var blockLines []string
+	inBlock := false
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+
+		if inBlock {
+			if strings.TrimSpace(line) == "}" {
+				block[blockAddr] = joinComment(block[blockAddr], strings.Join(blockLines, "\n"), "\n")
+				inBlock = false
+				continue
+			}
+			blockLines = append(blockLines, strings.TrimRight(line, " \t"))
+			continue
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.SplitN(line, " ", 2)
+		addr, err := ParseAddress(fields[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		text := ""
+		if len(fields) > 1 {
+			text = strings.TrimSpace(fields[1])
+		}
+
+		if text == "{" {
+			blockAddr = addr
+			blockLines = nil
+			inBlock = true
+			continue
+		}
+		inline[addr] = joinComment(inline[addr], text, "; ")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if inBlock {
+		return nil, nil, fmt.Errorf("line %d: unterminated block comment for &%04X", lineNum, blockAddr)
+	}
+
+	return inline, block, nil
+}
+
+// AddComments adds inline and block comments keyed by address to the
+// disassembly. Comments for an address that already has one are appended.
+func (d *Disassembler) AddComments(inline, block map[uint]string) {
+	for addr, text := range inline {
+		d.Comments[addr] = joinComment(d.Comments[addr], text, "; ")
+	}
+	for addr, text := range block {
+		d.BlockComments[addr] = joinComment(d.BlockComments[addr], text, "\n")
+	}
+}
+
+func joinComment(existing, text, sep string) string {
+	if existing == "" {
+		return text
+	}
+	return existing + sep + text
+}
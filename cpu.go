@@ -0,0 +1,191 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CPU identifies a member of the 6502 family. Each has its own instruction
+// set.
+type CPU int
+
+// CPUs
+//  CPU6502   - NMOS 6502, the BBC Micro Model B
+//  CPU65C02  - CMOS 65C02, the Master 128, Master Compact and 6502 Second
+//              Processor
+//  CPUR65C02 - Rockwell R65C02, a 65C02 with bit manipulation instructions
+const (
+	CPU6502 CPU = iota
+	CPU65C02
+	CPUR65C02
+)
+
+var cpuNames = []string{"6502", "65c02", "r65c02"}
+
+func (c CPU) String() string {
+	if int(c) < len(cpuNames) {
+		return cpuNames[c]
+	}
+	return fmt.Sprintf("CPU(%d)", int(c))
+}
+
+// ParseCPU converts a CPU name, as returned by CPU.String(), into a CPU
+func ParseCPU(s string) (CPU, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range cpuNames {
+		if name == s {
+			return CPU(i), nil
+		}
+	}
+	return CPU6502, fmt.Errorf("unknown CPU %q", s)
+}
+
+// CMOS is true for the 65C02 variants
+func (c CPU) CMOS() bool {
+	return c != CPU6502
+}
+
+// Opcodes returns the map from opcode byte value to Opcode for the CPU
+func (c CPU) Opcodes() map[byte]Opcode {
+	if m, ok := cmosOpcodeMaps[c]; ok {
+		return m
+	}
+	return OpCodesMap
+}
+
+// OpJMPAbsoluteX is the 65C02 JMP (&1234,X) instruction
+const OpJMPAbsoluteX = 0x7C
+
+var (
+
+	// OpCodes65C02 defines the instructions the CMOS 65C02 adds to the
+	// documented NMOS instructions in OpCodes. The remaining byte values are
+	// NOPs of varying length, see opCodes65C02NOPs.
+	// From http://www.6502.org/tutorials/65c02opcodes.html
+	OpCodes65C02 = []Opcode{
+		{0x72, "ADC", 2, ZeroPageIndirect, Documented},
+		{0x32, "AND", 2, ZeroPageIndirect, Documented},
+		{0x89, "BIT", 2, Immediate, Documented},
+		{0x34, "BIT", 2, ZeroPageX, Documented},
+		{0x3C, "BIT", 3, AbsoluteX, Documented},
+		{0x80, "BRA", 2, None, Documented}, // branches have special cased printing
+		{0xD2, "CMP", 2, ZeroPageIndirect, Documented},
+		{0x3A, "DEC", 1, Accumulator, Documented},
+		{0x52, "EOR", 2, ZeroPageIndirect, Documented},
+		{0x1A, "INC", 1, Accumulator, Documented},
+		{OpJMPAbsoluteX, "JMP", 3, AbsoluteIndirectX, Documented},
+		{0xB2, "LDA", 2, ZeroPageIndirect, Documented},
+		{0x12, "ORA", 2, ZeroPageIndirect, Documented},
+		{0xDA, "PHX", 1, None, Documented},
+		{0x5A, "PHY", 1, None, Documented},
+		{0xFA, "PLX", 1, None, Documented},
+		{0x7A, "PLY", 1, None, Documented},
+		{0xF2, "SBC", 2, ZeroPageIndirect, Documented},
+		{0x92, "STA", 2, ZeroPageIndirect, Documented},
+		{0x64, "STZ", 2, ZeroPage, Documented},
+		{0x74, "STZ", 2, ZeroPageX, Documented},
+		{0x9C, "STZ", 3, Absolute, Documented},
+		{0x9E, "STZ", 3, AbsoluteX, Documented},
+		{0x14, "TRB", 2, ZeroPage, Documented},
+		{0x1C, "TRB", 3, Absolute, Documented},
+		{0x04, "TSB", 2, ZeroPage, Documented},
+		{0x0C, "TSB", 3, Absolute, Documented},
+	}
+
+	// OpCodesRockwell defines the bit manipulation instructions of the Rockwell
+	// R65C02 which replace single byte NOPs of the 65C02. RMB and SMB reset and
+	// set a bit in zero page, BBR and BBS branch if a zero page bit is reset or
+	// set.
+	OpCodesRockwell = []Opcode{
+		{0x07, "RMB0", 2, ZeroPage, Documented},
+		{0x17, "RMB1", 2, ZeroPage, Documented},
+		{0x27, "RMB2", 2, ZeroPage, Documented},
+		{0x37, "RMB3", 2, ZeroPage, Documented},
+		{0x47, "RMB4", 2, ZeroPage, Documented},
+		{0x57, "RMB5", 2, ZeroPage, Documented},
+		{0x67, "RMB6", 2, ZeroPage, Documented},
+		{0x77, "RMB7", 2, ZeroPage, Documented},
+		{0x87, "SMB0", 2, ZeroPage, Documented},
+		{0x97, "SMB1", 2, ZeroPage, Documented},
+		{0xA7, "SMB2", 2, ZeroPage, Documented},
+		{0xB7, "SMB3", 2, ZeroPage, Documented},
+		{0xC7, "SMB4", 2, ZeroPage, Documented},
+		{0xD7, "SMB5", 2, ZeroPage, Documented},
+		{0xE7, "SMB6", 2, ZeroPage, Documented},
+		{0xF7, "SMB7", 2, ZeroPage, Documented},
+		{0x0F, "BBR0", 3, ZeroPageRelative, Documented},
+		{0x1F, "BBR1", 3, ZeroPageRelative, Documented},
+		{0x2F, "BBR2", 3, ZeroPageRelative, Documented},
+		{0x3F, "BBR3", 3, ZeroPageRelative, Documented},
+		{0x4F, "BBR4", 3, ZeroPageRelative, Documented},
+		{0x5F, "BBR5", 3, ZeroPageRelative, Documented},
+		{0x6F, "BBR6", 3, ZeroPageRelative, Documented},
+		{0x7F, "BBR7", 3, ZeroPageRelative, Documented},
+		{0x8F, "BBS0", 3, ZeroPageRelative, Documented},
+		{0x9F, "BBS1", 3, ZeroPageRelative, Documented},
+		{0xAF, "BBS2", 3, ZeroPageRelative, Documented},
+		{0xBF, "BBS3", 3, ZeroPageRelative, Documented},
+		{0xCF, "BBS4", 3, ZeroPageRelative, Documented},
+		{0xDF, "BBS5", 3, ZeroPageRelative, Documented},
+		{0xEF, "BBS6", 3, ZeroPageRelative, Documented},
+		{0xFF, "BBS7", 3, ZeroPageRelative, Documented},
+	}
+
+	// Maps from opcode byte value to Opcode for the CMOS CPUs. Initialized by
+	// init()
+	cmosOpcodeMaps map[CPU]map[byte]Opcode
+
+	// Mnemonic prefixes of the Rockwell bit manipulation instructions
+	bitInstructions = []string{"RMB", "SMB", "BBR", "BBS"}
+)
+
+func init() {
+	cmosOpcodeMaps = map[CPU]map[byte]Opcode{
+		CPU65C02:  buildCMOSOpcodeMap(OpCodes, OpCodes65C02),
+		CPUR65C02: buildCMOSOpcodeMap(OpCodes, OpCodes65C02, OpCodesRockwell),
+	}
+}
+
+// buildCMOSOpcodeMap merges the opcode tables, filling every unused byte value
+// with the NOP the 65C02 executes for it.
+func buildCMOSOpcodeMap(tables ...[]Opcode) map[byte]Opcode {
+	m := make(map[byte]Opcode)
+	for _, table := range tables {
+		for _, op := range table {
+			m[op.Value] = op
+		}
+	}
+	for i := 0; i < 256; i++ {
+		if _, ok := m[byte(i)]; !ok {
+			m[byte(i)] = cmosNOP(byte(i))
+		}
+	}
+	return m
+}
+
+// cmosNOP returns the NOP a 65C02 executes for an unused opcode byte. Unlike
+// the NMOS 6502 there are no undocumented instructions, although the length
+// of the NOPs varies and the assemblers will not emit them.
+func cmosNOP(b byte) Opcode {
+	switch {
+	case b&0x1F == 0x02:
+		return Opcode{b, "NOP", 2, Immediate, Stable}
+	case b == 0x44:
+		return Opcode{b, "NOP", 2, ZeroPage, Stable}
+	case b == 0x54 || b == 0xD4 || b == 0xF4:
+		return Opcode{b, "NOP", 2, ZeroPageX, Stable}
+	case b == 0x5C || b == 0xDC || b == 0xFC:
+		return Opcode{b, "NOP", 3, Absolute, Stable}
+	}
+	return Opcode{b, "NOP", 1, None, Stable}
+}
+
+// isBitInstruction is true for the Rockwell bit manipulation instructions
+func (o *Opcode) isBitInstruction() bool {
+	for _, v := range bitInstructions {
+		if strings.HasPrefix(o.Name, v) && len(o.Name) == 4 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,502 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect is the syntax of the assembler the disassembly is written for
+type Dialect interface {
+	// Name returns the name of the dialect, as accepted by ParseDialect
+	Name() string
+
+	// Hex returns val in hexadecimal with at least digits digits
+	Hex(val uint, digits int) string
+
+	// Comment returns the characters that start a comment
+	Comment() string
+
+	// Label returns the definition of a label
+	Label(name string) string
+
+	// Assign returns the definition of a symbol with a value
+	Assign(name, value string) string
+
+	// Symbol returns the name of an OS call or vector as it can be written
+	Symbol(name string) string
+
+	// PC returns the symbol for the address of the current instruction
+	PC() string
+
+	// Accumulator returns the operand of accumulator addressing, e.g. ASL A
+	Accumulator() string
+
+	// LoByte and HiByte return the low and high bytes of an expression
+	LoByte(expr string) string
+	HiByte(expr string) string
+
+	// Bytes, Words and Text return data directives
+	Bytes(vals []string) string
+	Words(vals []string) string
+	Text(s string) string
+
+	// TextChar is true if b can be written in the string of Text
+	TextChar(b byte) bool
+
+	// Undocumented returns the support of the assembler for the undocumented
+	// instructions of the NMOS 6502
+	Undocumented() Support
+
+	// UndocumentedName returns the mnemonic the assembler uses for an
+	// undocumented instruction. It returns false if the assembler cannot
+	// assemble the instruction to the same bytes.
+	UndocumentedName(op Opcode) (string, bool)
+
+	// ForceAbsolute returns an instruction with absolute addressing of an
+	// address in zero page, written so that the assembler does not use zero
+	// page addressing instead. It returns false if the assembler cannot.
+	ForceAbsolute(mnemonic, operand string) (string, bool)
+
+	// Scope returns the directives opening and closing a scope for the local
+	// labels of a subroutine, empty if the assembler has none, and the prefix
+	// of local labels. Without a prefix every label in a scope is local.
+	Scope() (open, close, prefix string)
+
+	// Header and Footer return the templates of the lines before and after
+	// the program, see headerLines
+	Header() string
+	Footer() string
+
+	// Line returns the nth line, counting from zero, of the disassembly as
+	// written to a file
+	Line(n int, text string) (string, error)
+}
+
+// Support is how much of the undocumented instructions an assembler accepts
+type Support int
+
+// Support levels
+//  NoSupport     - none, they are written as data
+//  StableSupport - the Stable instructions
+//  FullSupport   - all of them, including the Unstable, Magic and Jam ones
+const (
+	NoSupport Support = iota
+	StableSupport
+	FullSupport
+)
+
+// Includes is true if the support level includes instructions of a stability
+func (s Support) Includes(st Stability) bool {
+	switch st {
+	case Documented:
+		return true
+	case Stable:
+		return s >= StableSupport
+	}
+	return s >= FullSupport
+}
+
+// Dialects
+//  Beebasm  - beebasm, the default
+//  CA65     - ca65 from cc65, with the stable undocumented instructions of
+//             its 6502X CPU
+//  ACME     - the ACME cross assembler, with the undocumented instructions of
+//             its 6510 CPU
+//  Tass64   - 64tass, with the undocumented instructions of its 6502i CPU
+//  Ophis    - Ophis
+//  BBCBasic - the assembler of BBC BASIC, inside a two pass FOR loop
+var (
+	Beebasm Dialect = &syntax{
+		name:        "beebasm",
+		hexPrefix:   "&",
+		comment:     "\\",
+		label:       ".%s",
+		assign:      "%s = %s",
+		pc:          "P%",
+		accumulator: "A",
+		lo:          "LO(%s)",
+		hi:          "HI(%s)",
+		bytes:       "EQUB",
+		words:       "EQUW",
+		text:        "EQUS",
+		scope:       "{",
+		endScope:    "}",
+		header:      beebasmHeader,
+	}
+	CA65 Dialect = &syntax{
+		name:        "ca65",
+		hexPrefix:   "$",
+		comment:     ";",
+		label:       "%s:",
+		assign:      "%s = %s",
+		pc:          "*",
+		accumulator: "A",
+		lo:          "<%s",
+		hi:          ">%s",
+		bytes:       ".byte",
+		words:       ".word",
+		text:        ".byte",
+		force:       "%s a:%s",
+		support:     StableSupport,
+		mnemonics:   map[string]string{"SBX": "AXS", "USBC": ""},
+		scope:       ".scope",
+		endScope:    ".endscope",
+		header:      ca65Header,
+	}
+	ACME Dialect = &syntax{
+		name:      "acme",
+		hexPrefix: "$",
+		comment:   ";",
+		label:     "%s",
+		assign:    "%s = %s",
+		pc:        "*",
+		lo:        "<%s",
+		hi:        ">%s",
+		bytes:     "!byte",
+		words:     "!word",
+		text:      "!text",
+		escapes:   "\\",
+		force:     "%s+2 %s",
+		support:   FullSupport,
+		mnemonics: map[string]string{"ALR": "ASR", "KIL": "JAM", "USBC": ""},
+		scope:     "!zone {",
+		endScope:  "}",
+		local:     ".",
+		header:    acmeHeader,
+	}
+	Tass64 Dialect = &syntax{
+		name:        "64tass",
+		hexPrefix:   "$",
+		comment:     ";",
+		label:       "%s",
+		assign:      "%s = %s",
+		pc:          "*",
+		accumulator: "A",
+		lo:          "<%s",
+		hi:          ">%s",
+		bytes:       ".byte",
+		words:       ".word",
+		text:        ".text",
+		force:       "%s @w %s",
+		support:     FullSupport,
+		mnemonics:   map[string]string{"KIL": "JAM", "USBC": ""},
+		scope:       ".block",
+		endScope:    ".bend",
+		header:      tass64Header,
+	}
+	Ophis Dialect = &syntax{
+		name:      "ophis",
+		hexPrefix: "$",
+		comment:   ";",
+		label:     "%s:",
+		assign:    ".alias %s %s",
+		pc:        "^",
+		lo:        "<%s",
+		hi:        ">%s",
+		bytes:     ".byte",
+		words:     ".word",
+		text:      ".byte",
+		escapes:   "\\",
+		scope:     ".scope",
+		endScope:  ".scend",
+		local:     "_",
+		header:    ophisHeader,
+	}
+	BBCBasic Dialect = &basicSyntax{syntax{
+		name:        "basic",
+		hexPrefix:   "&",
+		comment:     "\\",
+		label:       ".%s",
+		assign:      "%s=%s",
+		pc:          "P%",
+		accumulator: "A",
+		lo:          "(%s) MOD 256",
+		hi:          "(%s) DIV 256",
+		bytes:       "EQUB",
+		words:       "EQUW",
+		text:        "EQUS",
+		header:      basicHeader,
+		footer:      "]\nNEXT pass%\n",
+	}}
+
+	// Dialects lists the dialects in the order of the documentation
+	Dialects = []Dialect{Beebasm, CA65, ACME, Tass64, Ophis, BBCBasic}
+)
+
+// ParseDialect returns the dialect with a name, as returned by Dialect.Name()
+func ParseDialect(s string) (Dialect, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for _, dl := range Dialects {
+		if dl.Name() == s {
+			return dl, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown dialect %q", s)
+}
+
+// syntax is a Dialect described by the formats of its parts
+type syntax struct {
+	name        string
+	hexPrefix   string
+	comment     string
+	label       string // format of a label definition
+	assign      string // format of a symbol definition, name then value
+	pc          string
+	accumulator string
+	lo, hi      string // formats of the low and high byte of an expression
+	bytes       string
+	words       string
+	text        string
+	escapes     string // characters other than " that cannot be in a string
+	force       string // format of a forced absolute instruction, if possible
+	support     Support
+	mnemonics   map[string]string // undocumented mnemonics that differ, or "" if unsupported
+	scope       string            // directive opening a scope, if there are scopes
+	endScope    string            // directive closing it
+	local       string            // prefix of local labels
+	header      string
+	footer      string
+}
+
+func (s *syntax) Name() string {
+	return s.name
+}
+
+func (s *syntax) Hex(val uint, digits int) string {
+	return fmt.Sprintf("%s%0*X", s.hexPrefix, digits, val)
+}
+
+func (s *syntax) Comment() string {
+	return s.comment
+}
+
+func (s *syntax) Label(name string) string {
+	return fmt.Sprintf(s.label, name)
+}
+
+func (s *syntax) Assign(name, value string) string {
+	return fmt.Sprintf(s.assign, name, value)
+}
+
+func (s *syntax) Symbol(name string) string {
+	return name
+}
+
+func (s *syntax) PC() string {
+	return s.pc
+}
+
+func (s *syntax) Accumulator() string {
+	return s.accumulator
+}
+
+func (s *syntax) LoByte(expr string) string {
+	return fmt.Sprintf(s.lo, expr)
+}
+
+func (s *syntax) HiByte(expr string) string {
+	return fmt.Sprintf(s.hi, expr)
+}
+
+func (s *syntax) Bytes(vals []string) string {
+	return s.bytes + " " + strings.Join(vals, ",")
+}
+
+func (s *syntax) Words(vals []string) string {
+	return s.words + " " + strings.Join(vals, ",")
+}
+
+func (s *syntax) Text(text string) string {
+	return s.text + " \"" + text + "\""
+}
+
+func (s *syntax) TextChar(b byte) bool {
+	return isStringChar(b) && strings.IndexByte(s.escapes, b) < 0
+}
+
+func (s *syntax) Undocumented() Support {
+	return s.support
+}
+
+// UndocumentedName supports the instructions that assemble back to the same
+// opcode, see isPreferredOpcode
+func (s *syntax) UndocumentedName(op Opcode) (string, bool) {
+	if !s.support.Includes(op.Stability) || !isPreferredOpcode(op) {
+		return "", false
+	}
+	name, ok := s.mnemonics[op.Name]
+	if !ok {
+		return op.Name, true
+	}
+	return name, name != ""
+}
+
+func (s *syntax) ForceAbsolute(mnemonic, operand string) (string, bool) {
+	if s.force == "" {
+		return "", false
+	}
+	return fmt.Sprintf(s.force, mnemonic, operand), true
+}
+
+func (s *syntax) Scope() (open, close, prefix string) {
+	return s.scope, s.endScope, s.local
+}
+
+func (s *syntax) Header() string {
+	return s.header
+}
+
+func (s *syntax) Footer() string {
+	return s.footer
+}
+
+func (s *syntax) Line(n int, text string) (string, error) {
+	return text, nil
+}
+
+// basicSyntax is BBC BASIC, whose program lines are numbered
+type basicSyntax struct {
+	syntax
+}
+
+// maxBasicLine is the highest line number of a BBC BASIC program
+const maxBasicLine = 32767
+
+// Symbol lower cases names starting with a keyword, which BBC BASIC would
+// otherwise read as the keyword, e.g. REM in REMV
+func (s *basicSyntax) Symbol(name string) string {
+	for _, kw := range basicKeywords {
+		if strings.HasPrefix(name, kw) {
+			return strings.ToLower(name)
+		}
+	}
+	return name
+}
+
+// Line numbers the lines in tens. Colons in a comment are replaced as they
+// would end the comment.
+func (s *basicSyntax) Line(n int, text string) (string, error) {
+	number := (n + 1) * 10
+	if number > maxBasicLine {
+		return "", fmt.Errorf("the disassembly has more lines than BBC BASIC allows")
+	}
+	if text == "" {
+		return fmt.Sprint(number), nil
+	}
+
+	quoted := false
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && !quoted:
+			text = text[:i] + strings.ReplaceAll(text[i:], ":", ".")
+			i = len(text)
+		}
+	}
+	return fmt.Sprintf("%d %s", number, text), nil
+}
+
+// basicKeywords are the BBC BASIC keywords that may start a name
+var basicKeywords = []string{
+	"ABS", "ACS", "ADVAL", "AND", "ASC", "ASN", "ATN", "AUTO", "BGET", "BPUT",
+	"CALL", "CHAIN", "CHR$", "CLEAR", "CLG", "CLOSE", "CLS", "COLOUR", "COS",
+	"COUNT", "DATA", "DEF", "DEG", "DELETE", "DIM", "DIV", "DRAW", "ELSE",
+	"END", "ENVELOPE", "EOF", "EOR", "ERL", "ERR", "EVAL", "EXP", "EXT",
+	"FALSE", "FN", "FOR", "GCOL", "GET", "GOSUB", "GOTO", "HIMEM", "IF",
+	"INKEY", "INPUT", "INSTR(", "INT", "LEFT$(", "LEN", "LET", "LINE", "LIST",
+	"LN", "LOAD", "LOCAL", "LOG", "LOMEM", "MID$(", "MOD", "MODE", "MOVE",
+	"NEW", "NEXT", "NOT", "OFF", "OLD", "ON", "OPENIN", "OPENOUT", "OPENUP",
+	"OPT", "OR", "OSCLI", "PAGE", "PI", "PLOT", "POINT(", "POS", "PRINT",
+	"PROC", "PTR", "RAD", "READ", "REM", "RENUMBER", "REPEAT", "REPORT",
+	"RESTORE", "RETURN", "RIGHT$(", "RND", "RUN", "SAVE", "SGN", "SIN",
+	"SOUND", "SPC", "SQR", "STEP", "STOP", "STR$", "STRING$(", "TAB(", "TAN",
+	"THEN", "TIME", "TO", "TOP", "TRACE", "TRUE", "UNTIL", "USR", "VAL", "VDU",
+	"VPOS", "WIDTH",
+}
+
+// headerTemplates are the parts of the header shared by the dialects
+var headerTemplates = `{{ define "banner" -}}
+{{ comment }} ******************************************************************************
+{{ comment }}
+{{ comment }} This disassembly was produced by bbcdisasm
+{{ comment }}
+{{ comment }} ******************************************************************************
+{{ end }}
+{{- define "symbols" -}}
+{{ if .UsedOSAddress }}{{ comment }} OS Call Addresses
+{{ $os := .OSAddress }}
+{{- range $addr, $elem := .UsedOSAddress }}{{ assign (printf "%-6s" (symbol (index $os $addr))) (hex $addr) }}
+{{ end }}
+{{- end }}
+{{ if .UsedOSVector }}{{ comment }} OS Vector Addresses
+{{ $vec := .OSVector }}
+{{- range $addr, $elem := .UsedOSVector }}{{ assign (printf "%-5s" (symbol (index $vec $addr))) (hex $addr) }}
+{{ end }}
+{{- end }}
+{{ if .Vars }}{{ comment }} Defined Variables
+{{ range $name, $value := .Vars }}{{ assign (printf "%-5s" $name) $value }}
+{{ end }}
+{{- end }}
+{{ end }}`
+
+var beebasmHeader = `{{ template "banner" . }}
+{{ template "symbols" . }}
+{{- if .CMOS }}CPU 1
+
+{{ end -}}
+{{ if .LoadAddr }}CODE% = {{ hex .LoadAddr }}
+
+ORG CODE%{{ if .Offset }}+{{ hex .Offset }}{{ end }}
+{{ else if .Offset }}ORG {{ hex .Offset }}
+{{ else -}}
+{{ end }}
+`
+
+var ca65Header = `{{ template "banner" . }}
+{{ template "symbols" . }}
+{{- if .CMOS }}.setcpu "65C02"{{ else if .Undocumented }}.setcpu "6502X"{{ else }}.setcpu "6502"{{ end }}
+
+.org {{ hex .Start }}
+
+`
+
+var acmeHeader = `{{ template "banner" . }}
+{{ template "symbols" . }}
+{{- if .Undocumented }}!cpu 6510{{ else }}{{ print "!cpu " .CPU }}{{ end }}
+
+* = {{ hex .Start }}
+
+`
+
+var tass64Header = `{{ template "banner" . }}
+{{ template "symbols" . }}
+{{- if .Undocumented }}.cpu "6502i"{{ else }}{{ printf ".cpu %q" .CPU.String }}{{ end }}
+
+* = {{ hex .Start }}
+
+`
+
+var ophisHeader = `{{ template "banner" . }}
+{{ template "symbols" . }}
+{{- if .CMOS }}{{ comment }} Assemble with ophis -c for the 65C02 instructions
+
+{{ end -}}
+.org {{ hex .Start }}
+
+`
+
+var basicHeader = `{{ $os := .OSAddress }}
+{{- range $addr, $elem := .UsedOSAddress }}{{ assign (symbol (index $os $addr)) (hex $addr) }}
+{{ end }}
+{{- $vec := .OSVector }}
+{{- range $addr, $elem := .UsedOSVector }}{{ assign (symbol (index $vec $addr)) (hex $addr) }}
+{{ end }}
+{{- range $name, $value := .Vars }}{{ assign $name $value }}
+{{ end -}}
+CODE%={{ hex .LoadAddr }}
+FOR pass%=0 TO 2 STEP 2
+P%=CODE%{{ if .Offset }}+{{ hex .Offset }}{{ end }}
+[OPT pass%
+{{ template "banner" . }}
+`
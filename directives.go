@@ -0,0 +1,353 @@
+package bbcdisasm
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// macro is a macro defined with MACRO name arg, ... ENDMACRO
+type macro struct {
+	name string
+	args []string
+	body []statement
+}
+
+// blockEnds maps the directives that open a block to the ones closing it
+var blockEnds = map[string]string{
+	"FOR":   "NEXT",
+	"MACRO": "ENDMACRO",
+	"IF":    "ENDIF",
+	"{":     "}",
+}
+
+// run assembles a list of statements
+func (a *Assembler) run(stmts []statement) error {
+	for i := 0; i < len(stmts); i++ {
+		s := stmts[i]
+		kw := keyword(s.text)
+		switch kw {
+		case "FOR", "MACRO", "IF", "{":
+			end, ok := blockEnd(stmts, i)
+			if !ok {
+				return s.errorf("%s without %s", kw, blockEnds[kw])
+			}
+			var err error
+			switch kw {
+			case "FOR":
+				err = a.forLoop(s, stmts[i+1:end])
+			case "MACRO":
+				err = a.defineMacro(s, stmts[i+1:end])
+			case "IF":
+				err = a.ifBlock(stmts[i : end+1])
+			case "{":
+				err = a.scoped(func() error { return a.run(stmts[i+1 : end]) })
+			}
+			if err != nil {
+				return err
+			}
+			i = end
+		case "NEXT", "ENDMACRO", "ELIF", "ELSE", "ENDIF", "}":
+			return s.errorf("unexpected %s", kw)
+		default:
+			if err := a.statement(s.text); err != nil {
+				if _, ok := err.(*sourceError); ok {
+					// From an included file or macro
+					return err
+				}
+				return s.errorf("%v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// keyword returns the directive at the start of a statement in upper case,
+// or a brace. It is empty for a symbol assignment.
+func keyword(text string) string {
+	if text == "{" || text == "}" {
+		return text
+	}
+	n := identLength(text)
+	if n == 0 || strings.HasPrefix(strings.TrimSpace(text[n:]), "=") {
+		return ""
+	}
+	return strings.ToUpper(text[:n])
+}
+
+// blockEnd returns the index of the statement closing the block opened at
+// stmts[i]
+func blockEnd(stmts []statement, i int) (int, bool) {
+	open := keyword(stmts[i].text)
+	depth := 0
+	for j := i + 1; j < len(stmts); j++ {
+		switch keyword(stmts[j].text) {
+		case open:
+			depth++
+		case blockEnds[open]:
+			if depth == 0 {
+				return j, true
+			}
+			depth--
+		}
+	}
+	return 0, false
+}
+
+// scoped runs fn in a new scope for labels and symbols
+func (a *Assembler) scoped(fn func() error) error {
+	a.scopes = append(a.scopes, a.nextScope)
+	a.nextScope++
+	err := fn()
+	a.scopes = a.scopes[:len(a.scopes)-1]
+	return err
+}
+
+// forLoop assembles the body of FOR var, start, end[, step] for each value of
+// the variable, each in its own scope
+func (a *Assembler) forLoop(s statement, body []statement) error {
+	args := splitTopLevel(strings.TrimSpace(s.text[len("FOR"):]), ',')
+	if len(args) < 3 || len(args) > 4 {
+		return s.errorf("FOR needs a variable, start, end and optional step")
+	}
+	name := strings.TrimSpace(args[0])
+	if n := identLength(name); n == 0 || n != len(name) {
+		return s.errorf("invalid FOR variable %q", name)
+	}
+	vals := []int{0, 0, 1}
+	for i, arg := range args[1:] {
+		val, err := a.eval(arg)
+		if err != nil {
+			return s.errorf("%v", err)
+		}
+		vals[i] = val
+	}
+	start, end, step := vals[0], vals[1], vals[2]
+	if step == 0 {
+		return s.errorf("FOR step cannot be zero")
+	}
+
+	for v := start; (step > 0 && v <= end) || (step < 0 && v >= end); v += step {
+		err := a.scoped(func() error {
+			if err := a.define(name, v, false); err != nil {
+				return s.errorf("%v", err)
+			}
+			return a.run(body)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ifBlock assembles the statements of the first true condition of a block
+// running from IF to ENDIF
+func (a *Assembler) ifBlock(stmts []statement) error {
+	start := 0
+	depth := 0
+	for j := 1; j < len(stmts); j++ {
+		kw := keyword(stmts[j].text)
+		switch {
+		case kw == "IF":
+			depth++
+		case kw == "ENDIF" && depth > 0:
+			depth--
+		case depth == 0 && (kw == "ELIF" || kw == "ELSE" || kw == "ENDIF"):
+			cond := stmts[start]
+			taken := true
+			if ckw := keyword(cond.text); ckw != "ELSE" {
+				val, err := a.eval(cond.text[len(ckw):])
+				if err != nil {
+					return cond.errorf("%v", err)
+				}
+				taken = val != 0
+			}
+			if taken {
+				return a.run(stmts[start+1 : j])
+			}
+			start = j
+		}
+	}
+	return nil
+}
+
+// defineMacro defines the macro MACRO name arg, ... with its body
+func (a *Assembler) defineMacro(s statement, body []statement) error {
+	def := strings.TrimSpace(s.text[len("MACRO"):])
+	n := identLength(def)
+	if n == 0 {
+		return s.errorf("MACRO needs a name")
+	}
+	m := &macro{name: def[:n], body: body}
+	if rest := strings.TrimSpace(def[n:]); rest != "" {
+		for _, arg := range splitTopLevel(rest, ',') {
+			arg = strings.TrimSpace(arg)
+			if n := identLength(arg); n == 0 || n != len(arg) {
+				return s.errorf("invalid macro argument %q", arg)
+			}
+			m.args = append(m.args, arg)
+		}
+	}
+	if _, ok := a.macros[m.name]; ok {
+		return s.errorf("macro %s is already defined", m.name)
+	}
+	a.macros[m.name] = m
+	return nil
+}
+
+// expand assembles the body of a macro in a new scope holding its arguments
+func (a *Assembler) expand(m *macro, list string) error {
+	var args []string
+	if list != "" {
+		args = splitTopLevel(list, ',')
+	}
+	if len(args) != len(m.args) {
+		return fmt.Errorf("macro %s needs %d arguments", m.name, len(m.args))
+	}
+	vals, err := a.evalList(args)
+	if err != nil {
+		return err
+	}
+	return a.nested(func() error {
+		return a.scoped(func() error {
+			for i, name := range m.args {
+				if err := a.define(name, vals[i], false); err != nil {
+					return err
+				}
+			}
+			return a.run(m.body)
+		})
+	})
+}
+
+// nested runs fn, an included file or macro, failing if they are nested too
+// deeply
+func (a *Assembler) nested(fn func() error) error {
+	if a.depth == maxAssemblyDepth {
+		return errors.New("INCLUDE and macros are nested too deeply")
+	}
+	a.depth++
+	err := fn()
+	a.depth--
+	return err
+}
+
+// include assembles the source file of INCLUDE "file"
+func (a *Assembler) include(arg string) error {
+	name, ok := stringLiteral(arg)
+	if !ok {
+		return errors.New(`INCLUDE needs a file name, INCLUDE "file"`)
+	}
+	text, err := a.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return a.nested(func() error {
+		return a.run(parseSource(name, string(text)))
+	})
+}
+
+// incbin assembles the bytes of the file of INCBIN "file"
+func (a *Assembler) incbin(arg string) error {
+	name, ok := stringLiteral(arg)
+	if !ok {
+		return errors.New(`INCBIN needs a file name, INCBIN "file"`)
+	}
+	data, err := a.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return a.emit(data...)
+}
+
+// save records the file of SAVE ["name",] start, end[, exec[, load]]. The
+// file name defaults to Output and the execution and load addresses to start.
+func (a *Assembler) save(list string) error {
+	name, args := a.Output, splitTopLevel(list, ',')
+	if s, ok := stringLiteral(strings.TrimSpace(args[0])); ok {
+		name, args = s, args[1:]
+	}
+	if name == "" {
+		return errors.New("SAVE needs a file name")
+	}
+	if len(args) < 2 || len(args) > 4 {
+		return errors.New("SAVE needs a start and end address")
+	}
+	vals, err := a.evalList(args)
+	if err != nil {
+		return err
+	}
+	start, end := vals[0], vals[1]
+	exec, load := start, start
+	if len(vals) > 2 {
+		exec = vals[2]
+	}
+	if len(vals) > 3 {
+		load = vals[3]
+	}
+	if a.out == nil {
+		return nil
+	}
+	if start < 0 || start > 0xFFFF || end < start || end > 0x10000 {
+		return fmt.Errorf("cannot save &%X to &%X", start, end)
+	}
+	a.out.Files = append(a.out.Files, AssembledFile{
+		Name: name,
+		Load: uint(load),
+		Exec: uint(exec),
+		Data: append([]byte(nil), a.out.Memory[start:end]...),
+	})
+	return nil
+}
+
+// putfile records the file of PUTFILE "host file", ["name",] load[, exec].
+// The name defaults to that of the host file and the execution address to the
+// load address.
+func (a *Assembler) putfile(list string) error {
+	args := splitTopLevel(list, ',')
+	host, ok := stringLiteral(strings.TrimSpace(args[0]))
+	if !ok {
+		return errors.New(`PUTFILE needs a file name, PUTFILE "file", load`)
+	}
+	name, args := filepath.Base(host), args[1:]
+	if len(args) > 0 {
+		if s, ok := stringLiteral(strings.TrimSpace(args[0])); ok {
+			name, args = s, args[1:]
+		}
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("PUTFILE needs a load address")
+	}
+	vals, err := a.evalList(args)
+	if err != nil {
+		return err
+	}
+	load, exec := vals[0], vals[0]
+	if len(vals) > 1 {
+		exec = vals[1]
+	}
+	if a.out == nil {
+		return nil
+	}
+	data, err := a.ReadFile(host)
+	if err != nil {
+		return err
+	}
+	a.out.Files = append(a.out.Files, AssembledFile{Name: name, Load: uint(load), Exec: uint(exec), Data: data})
+	return nil
+}
+
+// evalList evaluates a list of expressions
+func (a *Assembler) evalList(exprs []string) ([]int, error) {
+	vals := make([]int, len(exprs))
+	for i, expr := range exprs {
+		val, err := a.eval(expr)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
@@ -7,7 +7,6 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 )
 
 // Which types of data should the visit callback to walk be invoked for.
@@ -22,9 +21,22 @@ const (
 	vtAll  = ^visitMask(0)
 )
 
+// Limits on the amount of data printed on one line of a data region
+const (
+	maxBytesPerLine = 8
+	maxWordsPerLine = 4
+	maxCharsPerLine = 32
+)
+
+// maxAnalysisPasses limits how many times finding data in the program can
+// cause it to be analyzed again
+const maxAnalysisPasses = 4
+
 type varDef struct {
 	Sval string
 	Ival uint
+
+	imported bool // from a symbol file, only listed in the output if used
 }
 
 // Disassembler converts byte code to a textual representation
@@ -37,25 +49,97 @@ type Disassembler struct {
 	// addresses for relative branches.
 	BranchAdjust uint
 
+	// The CPU the program runs on, selecting the instruction set
+	CPU CPU
+
 	// The set of addresses in the program that the disassembler should ensure
 	// to disassemble. This is useful in cases where the disassembler skips
 	// addresses due to misinterpreting data bytes as opcodes.
-	// Will be modified by Disassemble().
 	CodeAddrs []uint
 
+	// Regions maps address ranges of the program to the type of their
+	// contents. Data regions are never decoded as instructions. Addresses are
+	// program addresses, that is including BranchAdjust.
+	Regions RegionMap
+
+	// Strings enables detection of text in the unknown parts of the program.
+	// Detected strings are marked in Regions by Disassemble().
+	Strings *StringDetector
+
+	// Inline declares the subroutines, by address, that take parameters from
+	// the bytes following the JSR. DetectInline enables recognition of others
+	// from their code. The data after each call is marked in Regions by
+	// Disassemble().
+	Inline       map[uint]InlineData
+	DetectInline bool
+
+	// IndirectTargets declares the possible targets of the indirect jump at
+	// an address. ResolveIndirect enables finding the targets of indirect
+	// jumps from the program. The targets are disassembled as code.
+	IndirectTargets map[uint][]uint
+	ResolveIndirect bool
+
+	// Tables enables detection of tables of addresses used to build
+	// pointers. Detected tables are marked in Regions by Disassemble().
+	Tables bool
+
+	// Subroutines enables detection of the extent of the subroutines called
+	// by JSR. They are named sub_XXXX and preceded by a header comment, and
+	// the branch labels inside them are local.
+	Subroutines bool
+
+	// Comments holds comments appended to the line disassembling an address
+	// and BlockComments comments printed above it.
+	Comments      map[uint]string
+	BlockComments map[uint]string
+
+	// Operands replaces the decoded operand of the instruction at an address
+	// with the given text, e.g. an expression like table+1.
+	Operands map[uint]string
+
+	// Dialect is the syntax of the assembler the disassembly is written for,
+	// Beebasm if nil.
+	Dialect Dialect
+
+	// CrossReferences adds the references to each address to the output, as
+	// comments on the labels or as a table after the program.
+	CrossReferences XRefStyle
+
+	codeAddrs     []uint // CodeAddrs as sorted program offsets
+	bounds        []uint // sorted program offsets instructions must not straddle
 	usedOSAddress map[uint]bool
 	usedOSVector  map[uint]bool
 	branchTargets map[uint]int
+	dataLabels    map[uint]bool   // labels on data referenced by operands
+	dataRefs      map[uint]uint   // data reference address to labelled address
+	namedLabels   map[uint]string // variables defining labels in the program
 	vars          map[string]varDef
+	varNames      map[uint]string // variable value to name
+	usedVars      map[string]bool
+	refCounts     map[uint]int    // number of operands referring to an address
+	entryPoints   map[uint]bool   // code addresses found by analysis
+	xrefs         map[uint][]XRef // address to the references to it
+
+	subroutines      map[uint]*subroutine // by entry address
+	subroutineLabels map[uint]string      // names of subroutines and local labels
+	qualifiedLabels  map[uint]string      // scoped local labels with the subroutine name
+	openScope        *subroutine          // the subroutine whose scope is open
 }
 
 // NewDisassembler initializes a new Disassembler with the target progrsm
 func NewDisassembler(program []byte) *Disassembler {
 	return &Disassembler{
-		Program:       program,
-		usedOSAddress: make(map[uint]bool),
-		usedOSVector:  make(map[uint]bool),
-		vars:          make(map[string]varDef),
+		Program:         program,
+		usedOSAddress:   make(map[uint]bool),
+		usedOSVector:    make(map[uint]bool),
+		vars:            make(map[string]varDef),
+		varNames:        make(map[uint]string),
+		Comments:        make(map[uint]string),
+		BlockComments:   make(map[uint]string),
+		Operands:        make(map[uint]string),
+		Inline:          make(map[uint]InlineData),
+		IndirectTargets: make(map[uint][]uint),
+		entryPoints:     make(map[uint]bool),
 	}
 }
 
@@ -75,43 +159,170 @@ func (d *Disassembler) AddVar(name, value string) error {
 	if err != nil {
 		return err
 	}
-	d.vars[name] = varDef{ovalue, uint(ival)}
+	d.setVar(name, varDef{Sval: ovalue, Ival: uint(ival)})
 	return nil
 }
 
-func (d *Disassembler) walk(vm visitMask, fn func(cursor uint, codeAddrIdx int, b byte, op Opcode, opOk bool) int) {
+// AddSymbols defines a variable for each symbol, see ParseSymbols. Symbols
+// for addresses inside the program become labels, others are treated like
+// variables from AddVar but only included in the disassembly if used.
+func (d *Disassembler) AddSymbols(syms []Symbol) {
+	for _, sym := range syms {
+		d.setVar(sym.Name, varDef{Sval: fmt.Sprintf("&%04X", sym.Addr), Ival: sym.Addr, imported: true})
+	}
+}
+
+func (d *Disassembler) setVar(name string, def varDef) {
+	if old, ok := d.vars[name]; ok && d.varNames[old.Ival] == name {
+		delete(d.varNames, old.Ival)
+	}
+	d.vars[name] = def
+
+	// The first name defined for a value is used in the disassembly
+	if _, ok := d.varNames[def.Ival]; !ok {
+		d.varNames[def.Ival] = name
+	}
+}
+
+// dialect returns the dialect of the output
+func (d *Disassembler) dialect() Dialect {
+	if d.Dialect == nil {
+		return Beebasm
+	}
+	return d.Dialect
+}
+
+// walk steps through the program from Offset visiting each instruction or
+// block of data. fn is called for bytes that should be decoded as code with
+// the decoded instruction, or the error from Decode if they are not one. limit
+// is the program offset of the next forced instruction boundary which a
+// decoded instruction must not cross. dfn is called for bytes inside data
+// regions, but only if vm includes vtData; otherwise data regions are skipped.
+// Both callbacks return the number of bytes consumed, or a negative number to
+// stop the walk.
+func (d *Disassembler) walk(vm visitMask, fn func(cursor, limit uint, in Instruction, err error) int, dfn func(cursor, limit uint, r Region) int) {
+	end := d.Offset + d.MaxBytes
 	cursor := d.Offset
-	prevCur := cursor
-	codeAddrIdx := 0
-	for cursor < (d.Offset + d.MaxBytes) {
-		// Do we have remaining code addresses?
-		if codeAddrIdx < len(d.CodeAddrs) {
-			// If we overstepped the next code address, pull the cursor back
-			ca := d.CodeAddrs[codeAddrIdx]
-			if prevCur < ca && cursor >= ca {
-				cursor = ca
-				codeAddrIdx++
+	boundIdx := 0
+	for cursor < end {
+		// Find the next forced boundary after the cursor
+		for boundIdx < len(d.bounds) && d.bounds[boundIdx] <= cursor {
+			boundIdx++
+		}
+		limit := ^uint(0)
+		if boundIdx < len(d.bounds) {
+			limit = d.bounds[boundIdx]
+		}
+
+		// Known data is never decoded as instructions
+		if r := d.Regions.Lookup(cursor + d.BranchAdjust); r.Type.isData() {
+			if vm&vtData == 0 {
+				cursor = limit
+				continue
+			}
+			if limit > end {
+				limit = end
+			}
+			n := dfn(cursor, limit, r)
+			if n < 0 {
+				return
 			}
+			cursor += uint(n)
+			continue
 		}
-		prevCur = cursor
 
-		// All instructions are at least one byte long and the first byte is
-		// sufficient to identify the opcode.
-		b := d.Program[cursor]
-		op, opOk := OpCodesMap[b]
+		in, err := d.CPU.Decode(d.Program[cursor:end], cursor+d.BranchAdjust)
 
-		// If the decoded 'instruction' straddles a code address then treat it
-		// as data.
-		if opOk && codeAddrIdx < len(d.CodeAddrs) {
-			if cursor+op.Length >= d.CodeAddrs[codeAddrIdx] {
-				if vm&vtData == 0 {
-					cursor = d.CodeAddrs[codeAddrIdx]
-					continue
-				}
+		// If the decoded 'instruction' straddles a boundary then treat it as
+		// data.
+		if err == nil && cursor+in.Length() > limit {
+			if vm&vtData == 0 {
+				cursor = limit
+				continue
 			}
 		}
 
-		cursor += uint(fn(cursor, codeAddrIdx, b, op, opOk))
+		n := fn(cursor, limit, in, err)
+		if n < 0 {
+			return
+		}
+		cursor += uint(n)
+	}
+}
+
+// analyze finds the labels, references and data in the program ahead of
+// printing it.
+func (d *Disassembler) analyze() {
+	d.computeBounds()
+	d.findBranchTargets()
+
+	// Finding data changes which bytes are code, so look again
+	for i := 0; i < maxAnalysisPasses && d.detectData(); i++ {
+		d.computeBounds()
+		d.findBranchTargets()
+	}
+
+	d.splitDataAtComments()
+	d.findSubroutines()
+}
+
+// detectData runs the enabled data detectors, returning true if any found
+// something new
+func (d *Disassembler) detectData() bool {
+	// Inline data comes first so strings after calls are split correctly,
+	// and strings last so they do not cover tables or the code they lead to
+	found := d.detectInline()
+	found = d.detectTables() || found
+	found = d.resolveIndirect() || found
+	found = d.detectStrings() || found
+	return found
+}
+
+// checkRange returns an error if the range to disassemble, MaxBytes from
+// Offset, is not inside the program
+func (d *Disassembler) checkRange() error {
+	size := uint(len(d.Program))
+	if d.Offset > size {
+		return fmt.Errorf("offset &%X is past the end of the program (&%X bytes)", d.Offset, size)
+	}
+	if d.MaxBytes > size-d.Offset {
+		return fmt.Errorf("&%X bytes from offset &%X is past the end of the program (&%X bytes)", d.MaxBytes, d.Offset, size)
+	}
+	return nil
+}
+
+// offsetOf converts a program address to an offset into Program
+func (d *Disassembler) offsetOf(addr uint) uint {
+	if addr < d.BranchAdjust {
+		return 0
+	}
+	return addr - d.BranchAdjust
+}
+
+// computeBounds gathers the program offsets that instructions must not
+// straddle: the targeted code addresses and the edges of all known regions.
+func (d *Disassembler) computeBounds() {
+	bounds := append([]uint(nil), d.codeAddrs...)
+	for addr := range d.entryPoints {
+		bounds = append(bounds, d.offsetOf(addr))
+	}
+	for _, r := range d.Regions.Regions() {
+		bounds = append(bounds, d.offsetOf(r.Start), d.offsetOf(r.End))
+	}
+	d.bounds = bounds
+	d.sortBounds()
+}
+
+// sortBounds sorts the boundaries and removes duplicates
+func (d *Disassembler) sortBounds() {
+	bounds := d.bounds
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+
+	d.bounds = bounds[:0]
+	for _, b := range bounds {
+		if n := len(d.bounds); n == 0 || d.bounds[n-1] != b {
+			d.bounds = append(d.bounds, b)
+		}
 	}
 }
 
@@ -119,161 +330,236 @@ func (d *Disassembler) walk(vm visitMask, fn func(cursor uint, codeAddrIdx int,
 // offset is where disassembly starts from the beginning of program.
 // branchAdjust is used to adjust the target address of relative branches to a
 // 'meaningful' address, typically the load address of the program.
-func (d *Disassembler) Disassemble(w io.Writer) {
-	if len(d.CodeAddrs) > 0 {
-		sort.Slice(d.CodeAddrs, func(i, j int) bool { return d.CodeAddrs[i] < d.CodeAddrs[j] })
-
-		for i, ca := range d.CodeAddrs {
-			d.CodeAddrs[i] = ca - d.BranchAdjust
+// An error is returned if the range to disassemble is not inside the program
+// or writing to w fails.
+func (d *Disassembler) Disassemble(w io.Writer) error {
+	dl := d.dialect()
+	n := 0
+	var werr error
+	err := d.Lines(func(l Line) bool {
+		var text string
+		if text, werr = dl.Line(n, formatLine(dl, l)); werr != nil {
+			return false
 		}
+		n++
+		_, werr = io.WriteString(w, text+"\n")
+		return werr == nil
+	})
+	if err != nil {
+		return err
 	}
+	return werr
+}
 
-	// First pass through program is to find the location of any branches. These
-	// will be marked as labels in the output.
-	d.findBranchTargets()
-
-	distem, _ := template.New("disasm").Parse(disasmHeader)
-	data := struct {
-		UsedOSAddress map[uint]bool
-		OSAddress     map[uint]string
-		UsedOSVector  map[uint]bool
-		OSVector      map[uint]string
-		Vars          map[string]varDef
-		LoadAddr      uint
-	}{d.usedOSAddress, addressToOsCallName, d.usedOSVector, osVectorAddresses, d.vars, d.BranchAdjust}
-	if err := distem.Execute(w, data); err != nil {
-		panic(err)
-	}
-
-	// Second pass through program is to decode each instruction
-	// and print to stdout.
-	d.walk(vtAll, func(cursor uint, codeAddrIdx int, b byte, op Opcode, opOk bool) int {
-		var sb strings.Builder
-		if targetIdx, ok := d.branchTargets[cursor+d.BranchAdjust]; ok {
-			sb.WriteByte('.')
-			sb.WriteString(fmt.Sprintf(labelFormatString, targetIdx))
-			sb.WriteString("\n")
-			w.Write([]byte(sb.String()))
-
-			sb.Reset()
+// formatLine returns the text of a line of disassembly
+func formatLine(dl Dialect, l Line) string {
+	var sb strings.Builder
+	switch l.Kind {
+	case LineLabel:
+		if l.Comment != "" {
+			return dl.Label(l.Text) + "  " + dl.Comment() + " " + l.Comment
 		}
+		return dl.Label(l.Text)
+	case LineComment:
+		return strings.TrimRight(dl.Comment()+" "+l.Text, " ")
+	case LineDirective:
+		return l.Text
+	case LineBlank:
+		return ""
+	case LineInstruction:
+		sb.WriteByte(' ')
+		printInstruction(&sb, dl, l)
+	case LineData:
 		sb.WriteByte(' ')
+		if l.Region.isData() {
+			printDirective(&sb, dl, l.Text, l.Bytes, l.Address)
+		} else {
+			// Bytes that are not a valid instruction have a note or the bytes
+			// repeated in the comment
+			printData(&sb, dl, l.Text, l.Bytes, l.Note == "", l.Address)
+			sb.WriteString(l.Note)
+			appendPrintableBytes(&sb, l.Bytes)
+		}
+	}
 
-		var advance uint
-
-		// Situations that can arise decoding the next instruction
-		// 1) If the byte does not match an opcode - print as data
-		// 2) If the byte matches a documented opcode:
-		//    a) If the instruction won't assemble identically then print as
-		//       data.
-		//    b) If the instruction straddles a targeted code address then print
-		//       as data the bytes up to the targeted address.
-		//    c) Otherwise, decode operands and print.
-		// 3) If the byte matches an undocumented opcode:
-		//    a) If the instruction straddles a targeted code address then print
-		//       as data the bytes up to the targeted address.
-		//    b) Otherwise retrieve operands, print as data, mark UD
-		if opOk {
-			instruction := d.Program[cursor : cursor+op.Length]
-			doc := isOpcodeDocumented(op)
-			wai := willAssembleIdentically(op, instruction)
-
-			var straddles bool
-			if codeAddrIdx < len(d.CodeAddrs) {
-				straddles = cursor+op.Length >= d.CodeAddrs[codeAddrIdx]
-			}
+	if l.Comment != "" {
+		sb.WriteString("  ")
+		sb.WriteString(l.Comment)
+	}
+	return sb.String()
+}
 
-			if doc && wai && !straddles {
-				// If here then documented instruction that will assemble correctly
-				d.printInstruction(&sb, op, instruction, cursor)
+// splitDataAtComments ensures lines of data start at addresses that have
+// comments, so each comment is placed next to the data it describes.
+func (d *Disassembler) splitDataAtComments() {
+	n := len(d.bounds)
+	for _, comments := range []map[uint]string{d.Comments, d.BlockComments} {
+		for addr := range comments {
+			if d.Regions.Lookup(addr).Type.isData() {
+				d.bounds = append(d.bounds, d.offsetOf(addr))
+			}
+		}
+	}
+	if len(d.bounds) != n {
+		d.sortBounds()
+	}
+}
 
-				advance = op.Length
-			} else {
-				// The opcode was unrecognized, the opcode belongs to an
-				// undocumented instruction, the instruction will straddle a
-				// targeted code address or beebasm will not assemble
-				// to the same bytes. In these cases treat it as data.
-
-				// If the data block straddles a targeted code address then trim
-				// to the address.
-				if straddles {
-					nb := d.CodeAddrs[codeAddrIdx] - cursor
-					instruction = instruction[:nb]
-				}
+// labelName returns the name of the label at addr, if there is one
+func (d *Disassembler) labelName(addr uint) (string, bool) {
+	if name, ok := d.namedLabels[addr]; ok {
+		return name, true
+	}
+	if name, ok := d.subroutineLabels[addr]; ok {
+		return name, true
+	}
+	if targetIdx, ok := d.branchTargets[addr]; ok {
+		return fmt.Sprintf(labelFormatString, targetIdx), true
+	}
+	if d.dataLabels[addr] {
+		return fmt.Sprintf(dataLabelFormatString, addr), true
+	}
+	return "", false
+}
 
-				// Include data bytes in comment section for visual consistency
-				// if the instruction is documented. Non documented instructions
-				// will print something else.
-				printData(&sb, instruction, doc, cursor+d.BranchAdjust)
-
-				if !doc {
-					// Undocumented instruction includes additional info before printable bytes
-					// EQUB [opcode],...,[opcode] \ [address] UD [instruction mnemonic]   [printable bytes]
-					//                            ^--- 25th column                        ^--- 45th column
-					sb.WriteString("UD ")
-					sb.WriteString(op.Name)
-				}
+// addrName returns the name of a code address, a label or a variable
+func (d *Disassembler) addrName(addr uint) (string, bool) {
+	if name, ok := d.labelName(addr); ok {
+		return name, true
+	}
+	return d.lookupVar(addr)
+}
 
-				appendPrintableBytes(&sb, instruction)
+// refName returns the name used by an operand referencing addr as data. This
+// is a label or an offset from one.
+func (d *Disassembler) refName(addr uint) (string, bool) {
+	anchor, ok := d.dataRefs[addr]
+	if !ok {
+		return "", false
+	}
+	name, _ := d.labelName(anchor)
+	if addr != anchor {
+		name += fmt.Sprintf("+%d", addr-anchor)
+	}
+	return name, true
+}
 
-				advance = uint(len(instruction))
+// regionData returns a single line of data from a data region starting at
+// cursor and not extending past limit, as a directive and the number of bytes
+// it holds.
+func (d *Disassembler) regionData(cursor, limit uint, r Region) (string, uint) {
+	data := d.Program[cursor:limit]
+	address := cursor + d.BranchAdjust
+	dl := d.dialect()
+
+	switch t := r.Type; t {
+	case RegionWords, RegionPointers:
+		if len(data) < 2 {
+			break
+		}
+		nw := len(data) / 2
+		if t == RegionPointers {
+			// Pointers are one per line so each target can be read easily
+			nw = 1
+		} else if nw > maxWordsPerLine {
+			nw = maxWordsPerLine
+		}
+		var out []string
+		for i := 0; i < nw; i++ {
+			val := uint(data[i*2]) + uint(data[i*2+1])<<8
+			if t == RegionPointers {
+				out = append(out, d.pointerName(val))
+			} else {
+				out = append(out, dl.Hex(val, 4))
 			}
-		} else {
-			bs := []byte{b}
-			printData(&sb, bs, true, cursor+d.BranchAdjust)
-			appendPrintableBytes(&sb, bs)
-			advance = 1
 		}
+		return dl.Words(out), uint(nw * 2)
+	case RegionString:
+		// Printable characters are grouped into an EQUS and everything else,
+		// including quotes and characters the assembler cannot have in a
+		// string, is emitted as bytes.
+		n := 0
+		for n < len(data) && n < maxCharsPerLine && dl.TextChar(data[n]) {
+			n++
+		}
+		if n > 0 {
+			return dl.Text(string(data[:n])), uint(n)
+		}
+		for n < len(data) && n < maxBytesPerLine && !dl.TextChar(data[n]) {
+			n++
+		}
+		return d.dataBytes(data[:n]), uint(n)
+	case RegionPointersLo, RegionPointersHi:
+		// Each byte is half of a pointer, one per line like RegionPointers
+		lo, hi := address, r.partnerAt(address)
+		fn := dl.LoByte
+		if t == RegionPointersHi {
+			lo, hi, fn = hi, lo, dl.HiByte
+		}
+		if !d.inProgram(lo) || !d.inProgram(hi) {
+			break
+		}
+		name := d.pointerName(d.tableEntry(lo, hi))
+		return dl.Bytes([]string{fn(name)}), 1
+	}
 
-		sb.WriteByte('\n')
-		w.Write([]byte(sb.String()))
+	if len(data) > maxBytesPerLine {
+		data = data[:maxBytesPerLine]
+	}
+	return d.dataBytes(data), uint(len(data))
+}
 
-		return int(advance)
-	})
+// pointerName returns the label for a pointer value if it has one, otherwise
+// the value as a hexadecimal address.
+func (d *Disassembler) pointerName(val uint) string {
+	if name, ok := d.refName(val); ok {
+		return name
+	}
+	if name, ok := d.labelName(val); ok {
+		return name
+	}
+	if osCall, ok := addressToOsCallName[val]; ok {
+		return d.dialect().Symbol(osCall)
+	}
+	return d.dialect().Hex(val, 4)
 }
 
-func (d *Disassembler) printInstruction(sb *strings.Builder, op Opcode, instruction []byte, cursor uint) {
+func printInstruction(sb *strings.Builder, dl Dialect, l Line) {
 	// A valid instruction will be printed to a line with format
 	//
-	// [instruction mnemonic]     \ [address] [instruction opcodes]   [printable bytes]
+	// [instruction mnemonic]     \\ [address] [instruction opcodes]   [printable bytes]
 	//                            ^--- 25th column                    ^--- 45th column
-	sb.WriteString(op.Name)
-	sb.WriteByte(' ')
-	sb.WriteString(d.decode(op, instruction, cursor))
+	sb.WriteString(l.Text)
 
 	appendSpaces(sb, max(24-sb.Len(), 1))
-	sb.WriteString("\\ ")
+	sb.WriteString(dl.Comment() + " ")
 
 	out := []string{
-		fmt.Sprintf("&%04X", cursor+d.BranchAdjust),
+		dl.Hex(l.Address, 4),
 	}
-	for _, i := range instruction {
+	for _, i := range l.Bytes {
 		out = append(out, fmt.Sprintf("%02X", i))
 	}
 	sb.WriteString(strings.Join(out, " "))
 
-	appendPrintableBytes(sb, instruction)
+	appendPrintableBytes(sb, l.Bytes)
 }
 
-// Print data in hex as comma-delimited EQUB statement. Assumes that there are
-// between 1 and 3 data bytes though it will handle any amount.
+// Print data written as directive, typically a comma-delimited EQUB statement
+// of the bytes. Assumes that there are between 1 and 3 data bytes though it
+// will handle any amount.
 // If bytesInComment is true then the data byte values will be repeated in the
 // comment section.
-func printData(sb *strings.Builder, data []byte, bytesInComment bool, address uint) {
+func printData(sb *strings.Builder, dl Dialect, directive string, data []byte, bytesInComment bool, address uint) {
 	// Data will be printed to a line with format
 	// EQUB &[byte],...,&[byte]    \ [address] [byte] ... [byte] [printable bytes]
 	//                             ^--- 25th column              ^--- 45th column
-	var out []string
-	for _, i := range data {
-		out = append(out, fmt.Sprintf("&%02X", i))
-	}
-	sb.WriteString("EQUB ")
-	sb.WriteString(strings.Join(out, ","))
+	sb.WriteString(directive)
 
 	appendSpaces(sb, max(24-sb.Len(), 1))
-	sb.WriteString("\\ ")
+	sb.WriteString(dl.Comment() + " ")
 
-	out = []string{fmt.Sprintf("&%04X", address)}
+	out := []string{dl.Hex(address, 4)}
 	if bytesInComment {
 		for _, i := range data {
 			out = append(out, fmt.Sprintf("%02X", i))
@@ -283,6 +569,33 @@ func printData(sb *strings.Builder, data []byte, bytesInComment bool, address ui
 	sb.WriteByte(' ')
 }
 
+// printDirective writes a data directive followed by a comment holding the
+// address and the printable form of data.
+func printDirective(sb *strings.Builder, dl Dialect, directive string, data []byte, address uint) {
+	// [directive]             \ [address]          [printable bytes]
+	//                         ^--- 25th column      ^--- 45th column
+	sb.WriteString(directive)
+
+	appendSpaces(sb, max(24-sb.Len(), 1))
+	sb.WriteString(dl.Comment() + " " + dl.Hex(address, 4))
+
+	appendPrintableBytes(sb, data)
+}
+
+// dataBytes returns a directive holding data in hexadecimal
+func (d *Disassembler) dataBytes(data []byte) string {
+	dl := d.dialect()
+	var out []string
+	for _, i := range data {
+		out = append(out, dl.Hex(uint(i), 2))
+	}
+	return dl.Bytes(out)
+}
+
+func isStringChar(b byte) bool {
+	return b >= 32 && b <= 126 && b != '"'
+}
+
 func appendSpaces(sb *strings.Builder, ns int) {
 	sb.Write(bytes.Repeat([]byte{' '}, ns))
 }
@@ -308,22 +621,18 @@ func max(a, b int) int {
 	return a
 }
 
-func isOpcodeDocumented(op Opcode) bool {
-	for _, u := range UndocumentedInstructions {
-		if op.Name == u {
-			return false
-		}
-	}
-
-	return true
-}
-
 // willAssembleIdentically checks if beebasm will assemble the instruction as written
 //
+// beebasm does not support the Rockwell bit manipulation instructions.
+//
 // Given an instruction with a 16-bit absolute address operand that lies in the
 // Zero Page e.g. LDA &0012, beebasm will instead assemble using the zero page
 // form if supported, e.g. LDA &12. This behavior breaks binary compatibility.
 func willAssembleIdentically(op Opcode, instruction []byte) bool {
+	if op.isBitInstruction() {
+		return false
+	}
+
 	if op.AddrMode == Absolute || op.AddrMode == AbsoluteX || op.AddrMode == AbsoluteY {
 		tgt := (uint(instruction[2]) << 8) + uint(instruction[1])
 		if tgt < 0x100 {
@@ -334,154 +643,228 @@ func willAssembleIdentically(op Opcode, instruction []byte) bool {
 	return true
 }
 
-func (d *Disassembler) decode(op Opcode, bytes []byte, cursor uint) string {
+// operandText returns the operand of an instruction as written in the
+// disassembly, using names for known addresses
+func (d *Disassembler) operandText(in Instruction) string {
+	dl := d.dialect()
+
 	// Jump and Branch instructions have special handling
-	if bytes[0] == OpJMPAbsolute || bytes[0] == OpJSRAbsolute {
+	if (in.Jump || in.Call) && in.Mode == Absolute {
 		// JMP &1234 and JSR &1234 are special cased with naming for well known
 		// OS call entry points.
-		return genAbsoluteOsCall(bytes, d.branchTargets)
+		return genAbsoluteOsCall(in.Target, d.addrName, dl)
+	}
+	if in.Mode == ZeroPageRelative {
+		zp := dl.Hex(in.Operand, 2)
+		if dvar, ok := d.lookupVar(in.Operand); ok {
+			zp = dvar
+		}
+		return zp + "," + genBranch(in, d.addrName, dl)
 	}
-	if op.branchOrJump() == btBranch {
-		return genBranch(bytes, cursor, d.BranchAdjust, d.branchTargets)
+	if in.Branch {
+		return genBranch(in, d.addrName, dl)
 	}
 
-	switch op.AddrMode {
+	switch in.Mode {
 	case None:
 		return ""
 	case Accumulator:
-		return "A"
+		return dl.Accumulator()
 	case Immediate:
-		return fmt.Sprintf("#&%02X", bytes[1])
+		return "#" + dl.Hex(in.Operand, 2)
 	case Absolute:
-		val := (uint(bytes[2]) << 8) + uint(bytes[1])
+		val := in.Operand
 
 		// Look up in the OS vector address space
 		if osv, ok := osVectorAddresses[val]; ok {
-			return osv
+			return dl.Symbol(osv)
 		}
 		// Try again with the bottom bit cleared because each vector is 16-bit
 		// eg. USERV vector is at 0x200 and 0x201.
 		if osv, ok := osVectorAddresses[val&^uint(1)]; ok {
-			return osv + "+1"
+			return dl.Symbol(osv) + "+1"
 		}
 
 		if dvar, ok := d.lookupVar(val); ok {
 			return dvar
 		}
+		if name, ok := d.refName(val); ok {
+			return name
+		}
 
 		// Unrecognized address, return as numeric
-		return fmt.Sprintf("&%04X", val)
+		return dl.Hex(val, 4)
 	case ZeroPage:
-		if dvar, ok := d.lookupVar(uint(bytes[1])); ok {
+		if dvar, ok := d.lookupVar(in.Operand); ok {
 			return dvar
 		}
-		return fmt.Sprintf("&%02X", bytes[1])
+		return dl.Hex(in.Operand, 2)
 	case ZeroPageX:
-		if dvar, ok := d.lookupVar(uint(bytes[1])); ok {
+		if dvar, ok := d.lookupVar(in.Operand); ok {
 			return dvar + ",X"
 		}
-		return fmt.Sprintf("&%02X,X", bytes[1])
+		return dl.Hex(in.Operand, 2) + ",X"
 	case ZeroPageY:
-		if dvar, ok := d.lookupVar(uint(bytes[1])); ok {
+		if dvar, ok := d.lookupVar(in.Operand); ok {
 			return dvar + ",Y"
 		}
-		return fmt.Sprintf("&%02X,Y", bytes[1])
+		return dl.Hex(in.Operand, 2) + ",Y"
 	case Indirect:
-		val := (uint(bytes[2]) << 8) + uint(bytes[1])
+		val := in.Operand
+		if osv, ok := osVectorAddresses[val]; ok {
+			return "(" + dl.Symbol(osv) + ")"
+		}
 		if dvar, ok := d.lookupVar(val); ok {
 			return "(" + dvar + ")"
 		}
-		return fmt.Sprintf("(&%04X)", val)
+		if name, ok := d.refName(val); ok {
+			return "(" + name + ")"
+		}
+		return "(" + dl.Hex(val, 4) + ")"
 	case AbsoluteX:
-		val := (uint(bytes[2]) << 8) + uint(bytes[1])
+		val := in.Operand
 		if dvar, ok := d.lookupVar(val); ok {
 			return dvar + ",X"
 		}
-		return fmt.Sprintf("&%04X,X", val)
+		if name, ok := d.refName(val); ok {
+			return name + ",X"
+		}
+		return dl.Hex(val, 4) + ",X"
 	case AbsoluteY:
-		val := (uint(bytes[2]) << 8) + uint(bytes[1])
+		val := in.Operand
 		if dvar, ok := d.lookupVar(val); ok {
 			return dvar + ",Y"
 		}
-		return fmt.Sprintf("&%04X,Y", val)
+		if name, ok := d.refName(val); ok {
+			return name + ",Y"
+		}
+		return dl.Hex(val, 4) + ",Y"
 	case IndirectX:
-		if dvar, ok := d.lookupVar(uint(bytes[1])); ok {
+		if dvar, ok := d.lookupVar(in.Operand); ok {
 			return "(" + dvar + ",X)"
 		}
-		return fmt.Sprintf("(&%02X,X)", bytes[1])
+		return "(" + dl.Hex(in.Operand, 2) + ",X)"
 	case IndirectY:
-		if dvar, ok := d.lookupVar(uint(bytes[1])); ok {
+		if dvar, ok := d.lookupVar(in.Operand); ok {
 			return "(" + dvar + "),Y"
 		}
-		return fmt.Sprintf("(&%02X),Y", bytes[1])
+		return "(" + dl.Hex(in.Operand, 2) + "),Y"
+	case ZeroPageIndirect:
+		if dvar, ok := d.lookupVar(in.Operand); ok {
+			return "(" + dvar + ")"
+		}
+		return "(" + dl.Hex(in.Operand, 2) + ")"
+	case AbsoluteIndirectX:
+		val := in.Operand
+		if dvar, ok := d.lookupVar(val); ok {
+			return "(" + dvar + ",X)"
+		}
+		if name, ok := d.refName(val); ok {
+			return "(" + name + ",X)"
+		}
+		return "(" + dl.Hex(val, 4) + ",X)"
 	default:
 		return "UNKNOWN ADDRESS MODE"
 	}
 }
 
 func (d *Disassembler) lookupVar(val uint) (name string, ok bool) {
-	for varn, varv := range d.vars {
-		if varv.Ival == val {
-			return varn, true
-		}
-	}
-
-	return "", false
+	name, ok = d.varNames[val]
+	return
 }
 
 func (d *Disassembler) findBranchTargets() {
 	// Track all reachable instructions. That is the address of the first
-	// opcode of each instruction starting at offset and moving forwards.
-	iloc := make(map[uint]bool)
+	// opcode of each instruction starting at offset and moving forwards,
+	// mapped to the length of the instruction.
+	iloc := make(map[uint]uint)
+
+	// Addresses inside the program referenced by instruction operands as data
+	refs := make(map[uint]bool)
+	start := d.Offset + d.BranchAdjust
+	end := start + d.MaxBytes
+	addRef := func(addr uint) {
+		if addr >= start && addr < end {
+			refs[addr] = true
+		}
+	}
 
+	d.usedOSAddress = make(map[uint]bool)
+	d.usedOSVector = make(map[uint]bool)
 	d.branchTargets = make(map[uint]int)
+	d.dataLabels = make(map[uint]bool)
+	d.dataRefs = make(map[uint]uint)
+	d.namedLabels = make(map[uint]string)
+	d.usedVars = make(map[string]bool)
+	d.refCounts = make(map[uint]int)
+	d.xrefs = make(map[uint][]XRef)
+
+	d.walk(vtCode, func(cursor, _ uint, in Instruction, err error) int {
+		iloc[cursor+d.BranchAdjust] = 1 // Reachable instruction
+		if err != nil {
+			return 1
+		}
 
-	d.walk(vtCode, func(cursor uint, _ int, b byte, op Opcode, opOk bool) int {
-		iloc[cursor+d.BranchAdjust] = true // Reachable instruction
-		if opOk {
-			instruction := d.Program[cursor : cursor+op.Length]
-			switch op.branchOrJump() {
-			case btBranch:
-				// This is ugly but it will do for now
-				boff := int(instruction[1]) // All branches are 2 bytes long
-				if boff > 127 {
-					boff = boff - 256
+		iloc[in.Address] = in.Length()
+		d.addXRefs(in)
+		switch {
+		case in.Branch:
+			d.refCounts[in.Target]++
+			if _, ok := d.branchTargets[in.Target]; !ok {
+				d.branchTargets[in.Target] = 0 // value will be filled out later
+			}
+		case in.Jump || in.Call:
+			// Skip indirect jumps since we don't know the target of the jump
+			if in.HasTarget {
+				if _, ok := d.branchTargets[in.Target]; !ok {
+					d.branchTargets[in.Target] = 0 // value will be filled out later
 				}
-				// Adjust d.Offset to account for the 2 byte behavior, see
-				// genBranch().
-				boff += 2
 
-				tgt := cursor + uint(boff) + d.BranchAdjust
-				if _, ok := d.branchTargets[tgt]; !ok {
-					d.branchTargets[tgt] = 0 // value will be filled out later
+				// If the jump target is a well known OS call then mark as seen
+				if _, ok := addressToOsCallName[in.Target]; ok {
+					d.usedOSAddress[in.Target] = true
 				}
-			case btJump:
-				// Skip indirect jump since we don't know the target of the jump
-				if b != OpJMPIndirect {
-					tgt := (uint(instruction[2]) << 8) + uint(instruction[1])
-					if _, ok := d.branchTargets[tgt]; !ok {
-						d.branchTargets[tgt] = 0 // value will be filled out later
-					}
-
-					// If the jump target is a well known OS call then mark as seen
-					if _, ok := addressToOsCallName[tgt]; ok {
-						d.usedOSAddress[tgt] = true
-					}
+			} else {
+				// The jump vector itself may be part of the program
+				if _, ok := osVectorAddresses[in.Operand]; ok && in.Mode == Indirect {
+					d.usedOSVector[in.Operand] = true
 				}
-			case btNeither:
-				// Check instructions with Absolute addressing
-				if op.AddrMode == Absolute {
-					tgt := (uint(instruction[2]) << 8) + uint(instruction[1])
-					if _, ok := osVectorAddresses[tgt]; ok {
-						d.usedOSVector[tgt] = true
-					}
+				addRef(in.Operand)
+			}
+		default:
+			// Check instructions with Absolute addressing
+			switch in.Mode {
+			case Absolute, AbsoluteX, AbsoluteY:
+				// The operand names the vector for either byte, e.g. USERV+1
+				if _, ok := osVectorAddresses[in.Target&^1]; ok && in.Mode == Absolute {
+					d.usedOSVector[in.Target&^1] = true
 				}
+				addRef(in.Target)
 			}
+		}
 
-			return len(instruction)
+		if val, ok := operandAddress(in.Opcode, in.Bytes); ok {
+			d.refCounts[val]++
+			if name, ok := d.lookupVar(val); ok {
+				d.usedVars[name] = true
+			}
 		}
 
-		return 1
+		return int(in.Length())
+	}, nil)
+
+	// Code addresses found in tables are labelled like jump targets, other
+	// addresses in tables are data references
+	for addr := range d.entryPoints {
+		if _, ok := d.branchTargets[addr]; !ok {
+			d.branchTargets[addr] = 0 // value will be filled out later
+		}
+	}
+	d.tablePointers(func(val uint) {
+		d.refCounts[val]++
+		if !d.entryPoints[val] {
+			addRef(val)
+		}
 	})
 
 	// Reject branch targets that point to unreachable instructions. This can
@@ -494,6 +877,9 @@ func (d *Disassembler) findBranchTargets() {
 		}
 	}
 
+	d.resolveDataRefs(iloc, refs)
+	d.resolveNamedLabels(iloc, start, end)
+
 	// Sort branch targets in order of increasing address
 	bt := make([]int, len(d.branchTargets))
 	i := 0
@@ -507,30 +893,143 @@ func (d *Disassembler) findBranchTargets() {
 	}
 }
 
-var disasmHeader = `\ ******************************************************************************
-\
-\ This disassembly was produced by bbcdisasm
-\
-\ ******************************************************************************
-
-{{ if .UsedOSAddress }}\ OS Call Addresses
-{{ $os := .OSAddress }}
-{{- range $addr, $elem := .UsedOSAddress }}{{ printf "%-6s" (index $os $addr) }} = {{ printf "&%0X" $addr }}
-{{ end }}
-{{- end }}
-{{ if .UsedOSVector }}\ OS Vector Addresses
-{{ $vec := .OSVector }}
-{{- range $addr, $elem := .UsedOSVector }}{{ printf "%-5s" (index $vec $addr) }} = {{ printf "&%0X" $addr }}
-{{ end }}
-{{- end }}
-{{ if .Vars }}\ Defined Variables
-{{ $var := .Vars }}
-{{- range $name, $value := .Vars }}{{ printf "%-5s" $name }} = {{ print $value.Sval }}
-{{ end }}
-{{- end }}
-{{ if .LoadAddr }}CODE% = {{ printf "&%X" .LoadAddr }}
-
-ORG CODE%
-{{ else -}}
-{{ end }}
-`
+// resolveDataRefs finds a label for each data reference. A reference to the
+// start of an instruction, or to anywhere in a data region, is labelled
+// directly. A reference into the middle of an instruction, typically self
+// modifying code, is expressed as an offset from a label on the instruction.
+func (d *Disassembler) resolveDataRefs(iloc map[uint]uint, refs map[uint]bool) {
+	starts := make([]uint, 0, len(iloc))
+	for addr := range iloc {
+		starts = append(starts, addr)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+
+	var bounds []uint
+	for addr := range refs {
+		anchor := addr
+		if d.Regions.Lookup(addr).Type.isData() {
+			// Data region output is split at the label
+			bounds = append(bounds, d.offsetOf(addr))
+		} else {
+			// Find the instruction containing the address
+			i := sort.Search(len(starts), func(i int) bool { return starts[i] > addr })
+			if i == 0 {
+				continue
+			}
+			anchor = starts[i-1]
+			if addr >= anchor+iloc[anchor] {
+				continue
+			}
+		}
+
+		d.dataRefs[addr] = anchor
+		if _, ok := d.branchTargets[anchor]; !ok {
+			d.dataLabels[anchor] = true
+		}
+	}
+
+	if len(bounds) > 0 {
+		d.bounds = append(d.bounds, bounds...)
+		d.sortBounds()
+	}
+}
+
+// Symbols returns the symbol table of the last disassembly: the labels in the
+// program, the OS calls and vectors it uses and the variables defined at the
+// top of the output. Local labels in the scope of a subroutine are named
+// after it, e.g. sub_1907_loop_1, so the names are unique. Symbols are sorted
+// by address.
+func (d *Disassembler) Symbols() []Symbol {
+	var syms []Symbol
+	for addr := range d.usedOSAddress {
+		syms = append(syms, Symbol{addressToOsCallName[addr], addr, SymbolOSCall, d.refCounts[addr]})
+	}
+	for addr := range d.usedOSVector {
+		refs := d.refCounts[addr] + d.refCounts[addr+1]
+		syms = append(syms, Symbol{osVectorAddresses[addr], addr, SymbolOSVector, refs})
+	}
+	for name, def := range d.headerVars() {
+		var refs int
+		if d.varNames[def.Ival] == name {
+			refs = d.refCounts[def.Ival]
+		}
+		syms = append(syms, Symbol{name, def.Ival, SymbolVar, refs})
+	}
+
+	// References into the middle of instructions count towards their label
+	offsetRefs := make(map[uint]int)
+	for ref, anchor := range d.dataRefs {
+		if ref != anchor {
+			offsetRefs[anchor] += d.refCounts[ref]
+		}
+	}
+	labels := make(map[uint]bool)
+	for addr := range d.branchTargets {
+		labels[addr] = true
+	}
+	for addr := range d.dataLabels {
+		labels[addr] = true
+	}
+	for addr := range d.namedLabels {
+		labels[addr] = true
+	}
+	for addr := range labels {
+		name, _ := d.labelName(addr)
+		if qualified, ok := d.qualifiedLabels[addr]; ok {
+			name = qualified
+		}
+		kind := SymbolLabel
+		if _, ok := d.branchTargets[addr]; !ok && (d.dataLabels[addr] || d.Regions.Lookup(addr).Type.isData()) {
+			kind = SymbolData
+		}
+		syms = append(syms, Symbol{name, addr, kind, d.refCounts[addr] + offsetRefs[addr]})
+	}
+
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].Addr != syms[j].Addr {
+			return syms[i].Addr < syms[j].Addr
+		}
+		return syms[i].Name < syms[j].Name
+	})
+	return syms
+}
+
+// resolveNamedLabels turns variables holding the address of an instruction or
+// data inside the program into labels, so they are defined at that location
+// rather than at the top of the disassembly.
+func (d *Disassembler) resolveNamedLabels(iloc map[uint]uint, start, end uint) {
+	var bounds []uint
+	for addr, name := range d.varNames {
+		if addr < start || addr >= end {
+			continue
+		}
+		if d.Regions.Lookup(addr).Type.isData() {
+			bounds = append(bounds, d.offsetOf(addr))
+		} else if _, ok := iloc[addr]; !ok {
+			continue
+		}
+		d.namedLabels[addr] = name
+	}
+
+	if len(bounds) > 0 {
+		d.bounds = append(d.bounds, bounds...)
+		d.sortBounds()
+	}
+}
+
+// headerVars returns the variables to be defined at the top of the
+// disassembly. Variables that became labels are defined where they are
+// located and imported symbols are only defined if used.
+func (d *Disassembler) headerVars() map[string]varDef {
+	vars := make(map[string]varDef)
+	for name, def := range d.vars {
+		if label, ok := d.namedLabels[def.Ival]; ok && label == name {
+			continue
+		}
+		if def.imported && !d.usedVars[name] {
+			continue
+		}
+		vars[name] = def
+	}
+	return vars
+}
@@ -0,0 +1,42 @@
+package bbcdisasm
+
+import (
+	"bytes"
+	"testing"
+)
+
+// disassemble returns the beebasm disassembly of the bytes of program from
+// offset, loaded at &1900
+func disassemble(t *testing.T, program []byte, offset, length uint) (*Disassembler, string) {
+	t.Helper()
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.Offset = offset
+	d.MaxBytes = length
+	var buf bytes.Buffer
+	if err := d.Disassemble(&buf); err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+	return d, buf.String()
+}
+
+func TestDisassembleLengthEndsMidInstruction(t *testing.T) {
+	// LDA #&00 : JMP &1234 : RTS with the length ending after the low byte
+	// of the JMP operand
+	program := []byte{0xA9, 0x00, 0x4C, 0x34, 0x12, 0x60}
+	d, src := disassemble(t, program, 0, 4)
+
+	if bytes.Contains([]byte(src), []byte("JMP")) {
+		t.Errorf("JMP straddling the end of the range is disassembled:\n%s", src)
+	}
+	if !bytes.Contains([]byte(src), []byte("EQUB &4C,&34")) {
+		t.Errorf("the bytes of the cut JMP are not written as data:\n%s", src)
+	}
+	diffs, err := d.Verify(bytes.NewBufferString(src))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("Verify: %v", diff)
+	}
+}
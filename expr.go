@@ -0,0 +1,257 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// exprParser evaluates an assembler expression. The operators and their
+// precedence follow BBC BASIC, from lowest to highest
+//  OR EOR
+//  AND
+//  = <> < > <= >=
+//  << >>
+//  + -
+//  * / DIV MOD
+//  ^
+//  unary - + NOT
+// Comparisons are -1 if true and 0 if false.
+type exprParser struct {
+	s    string
+	pos  int
+	a    *Assembler
+	name string // the undefined symbol, when errUndefined is returned
+}
+
+// exprLevels are the binary operators by increasing precedence
+var exprLevels = [][]string{
+	{"OR", "EOR"},
+	{"AND"},
+	{"<>", "<=", ">=", "=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "DIV", "MOD"},
+	{"^"},
+}
+
+// parse evaluates the whole expression
+func (p *exprParser) parse() (int, error) {
+	if strings.TrimSpace(p.s) == "" {
+		return 0, fmt.Errorf("missing expression")
+	}
+	val, err := p.binary(0)
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) {
+		return 0, fmt.Errorf("syntax error at %q", p.s[p.pos:])
+	}
+	return val, nil
+}
+
+// binary evaluates the operators of a precedence level, left to right
+func (p *exprParser) binary(level int) (int, error) {
+	if level == len(exprLevels) {
+		return p.unary()
+	}
+	val, err := p.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		op, ok := p.operator(exprLevels[level])
+		if !ok {
+			return val, nil
+		}
+		rhs, err := p.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		if val, err = applyOperator(op, val, rhs); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// operator consumes one of the operators ops if it is next
+func (p *exprParser) operator(ops []string) (string, bool) {
+	p.skipSpace()
+	for _, op := range ops {
+		if !strings.HasPrefix(p.s[p.pos:], op) {
+			continue
+		}
+		end := p.pos + len(op)
+		if isLetter(op[0]) && end < len(p.s) && (isLetter(p.s[end]) || p.s[end] == '_') {
+			// Part of a longer name
+			continue
+		}
+		if (op == "<" || op == ">") && end < len(p.s) && p.s[end] == op[0] {
+			// A shift
+			continue
+		}
+		p.pos = end
+		return op, true
+	}
+	return "", false
+}
+
+func applyOperator(op string, a, b int) (int, error) {
+	truth := func(t bool) int {
+		if t {
+			return -1
+		}
+		return 0
+	}
+	switch op {
+	case "OR":
+		return a | b, nil
+	case "EOR":
+		return a ^ b, nil
+	case "AND":
+		return a & b, nil
+	case "=":
+		return truth(a == b), nil
+	case "<>":
+		return truth(a != b), nil
+	case "<":
+		return truth(a < b), nil
+	case ">":
+		return truth(a > b), nil
+	case "<=":
+		return truth(a <= b), nil
+	case ">=":
+		return truth(a >= b), nil
+	case "<<":
+		return a << uint(b), nil
+	case ">>":
+		return a >> uint(b), nil
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "^":
+		val := 1
+		for i := 0; i < b; i++ {
+			val *= a
+		}
+		return val, nil
+	}
+	// Division
+	if b == 0 {
+		return 0, fmt.Errorf("division by zero")
+	}
+	if op == "MOD" {
+		return a % b, nil
+	}
+	return a / b, nil
+}
+
+// unary evaluates the unary operators and the values they apply to
+func (p *exprParser) unary() (int, error) {
+	if op, ok := p.operator([]string{"-", "+", "NOT"}); ok {
+		val, err := p.unary()
+		switch op {
+		case "-":
+			val = -val
+		case "NOT":
+			val = ^val
+		}
+		return val, err
+	}
+	return p.primary()
+}
+
+// primary evaluates a number, symbol, function or bracketed expression
+func (p *exprParser) primary() (int, error) {
+	p.skipSpace()
+	if p.pos == len(p.s) {
+		return 0, fmt.Errorf("missing value in %q", p.s)
+	}
+	rest := p.s[p.pos:]
+	switch c := rest[0]; {
+	case c == '(':
+		p.pos++
+		return p.bracketed()
+	case c == '&' || c == '$':
+		return p.number(1, 16)
+	case c == '%':
+		return p.number(1, 2)
+	case isDigit(c):
+		return p.number(0, 10)
+	}
+
+	n := identLength(rest)
+	if n == 0 {
+		return 0, fmt.Errorf("syntax error at %q", rest)
+	}
+	name := rest[:n]
+	p.pos += n
+
+	switch strings.ToUpper(name) {
+	case "LO", "HI":
+		p.skipSpace()
+		if p.pos == len(p.s) || p.s[p.pos] != '(' {
+			break
+		}
+		p.pos++
+		val, err := p.bracketed()
+		if strings.ToUpper(name) == "HI" {
+			val >>= 8
+		}
+		return val & 0xFF, err
+	}
+
+	val, ok := p.a.lookup(name)
+	if !ok {
+		p.name = name
+		return 0, errUndefined
+	}
+	return val, nil
+}
+
+// bracketed evaluates an expression followed by a closing parenthesis
+func (p *exprParser) bracketed() (int, error) {
+	val, err := p.binary(0)
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpace()
+	if p.pos == len(p.s) || p.s[p.pos] != ')' {
+		return 0, fmt.Errorf("missing ) in %q", p.s)
+	}
+	p.pos++
+	return val, nil
+}
+
+// number parses a number in base after a prefix of skip characters
+func (p *exprParser) number(skip, base int) (int, error) {
+	start := p.pos + skip
+	end := start
+	for end < len(p.s) && isBaseDigit(p.s[end], base) {
+		end++
+	}
+	val, err := strconv.ParseInt(p.s[start:end], base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", p.s[p.pos:end])
+	}
+	p.pos = end
+	return int(val), nil
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// isBaseDigit is true if c is a digit in base 2, 10 or 16
+func isBaseDigit(c byte, base int) bool {
+	if base == 16 {
+		return isDigit(c) || (c >= 'A' && c <= 'F') || (c >= 'a' && c <= 'f')
+	}
+	return c >= '0' && int(c-'0') < base
+}
@@ -0,0 +1,308 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// osCallDescriptions describes the OS calls in addressToOsCallName
+var osCallDescriptions = map[string]string{
+	"OSRDRM": "read a byte from a paged ROM",
+	"OSEVEN": "generate an event",
+	"GSINIT": "initialise reading a string",
+	"GSREAD": "read a character from a string",
+	"NVRDCH": "read a character, not vectored",
+	"NVWRCH": "write a character, not vectored",
+	"OSFIND": "open or close a file",
+	"OSRDCH": "read a character from the input stream",
+	"OSASCI": "write a character, CR as a new line",
+	"OSNEWL": "write a new line",
+	"OSWRCH": "write a character to the output stream",
+	"OSWORD": "OSWORD call, A selects the action",
+	"OSBYTE": "OSBYTE call, A selects the action",
+	"OSCLI":  "execute a * command",
+}
+
+var identifierRe = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+
+// htmlLine is a line of the HTML disassembly
+type htmlLine struct {
+	ID    string
+	Class string
+	HTML  template.HTML
+}
+
+// htmlSymbol is a symbol in the HTML disassembly
+type htmlSymbol struct {
+	Symbol
+	ID    string // anchor of the definition, from the address
+	Title string // tooltip of links to the symbol
+	Refs  []uint // addresses of the lines referring to it
+}
+
+// htmlIndexEntry is a link in the sidebar
+type htmlIndexEntry struct {
+	ID   string
+	Name string
+}
+
+// WriteHTML writes the disassembly as a single self-contained HTML page with
+// the given title. Labels and other symbols link to their definitions, which
+// list the lines referring to them. OS calls have a tooltip describing them,
+// lines are coloured by the type of region they belong to and a sidebar
+// indexes the subroutines, the targets of JSR, and the labels.
+func (d *Disassembler) WriteHTML(w io.Writer, title string) error {
+	var lines []Line
+	err := d.Lines(func(l Line) bool {
+		lines = append(lines, l)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Symbols by the name written in the source. Local labels of different
+	// subroutines can share a name, so each name has a list.
+	dl := d.dialect()
+	syms := make(map[string][]*htmlSymbol)
+	for _, sym := range d.Symbols() {
+		name := sym.Name
+		title := name + " = " + dl.Hex(sym.Addr, 4)
+		switch sym.Kind {
+		case SymbolOSCall:
+			name = dl.Symbol(name)
+			title = fmt.Sprintf("%s %s: %s", name, dl.Hex(sym.Addr, 4), osCallDescriptions[sym.Name])
+		case SymbolOSVector:
+			name = dl.Symbol(name)
+			title = fmt.Sprintf("%s %s: OS vector", name, dl.Hex(sym.Addr, 4))
+		default:
+			if d.qualifiedLabels[sym.Addr] == name {
+				name = d.subroutineLabels[sym.Addr]
+			}
+		}
+		id := fmt.Sprintf("sym-%04X", sym.Addr)
+		syms[name] = append(syms[name], &htmlSymbol{Symbol: sym, ID: id, Title: title})
+	}
+	lookup := func(at uint) func(string) *htmlSymbol {
+		return func(name string) *htmlSymbol { return d.htmlSymbol(syms[name], at) }
+	}
+
+	// The lines refer to the symbols named in their source, the definitions
+	// are the labels and the directives starting with a name
+	var subroutines, labels []htmlIndexEntry
+	seen := make(map[*htmlSymbol]bool)
+	defined := make(map[int]*htmlSymbol)
+	for i, l := range lines {
+		find := lookup(l.Address)
+		switch l.Kind {
+		case LineLabel:
+			if sym := find(l.Text); sym != nil {
+				defined[i] = sym
+				labels = append(labels, htmlIndexEntry{sym.ID, sym.Name})
+			}
+		case LineDirective:
+			if name, ok := definedName(l.Text); ok && find(name) != nil {
+				defined[i] = find(name)
+			}
+		case LineInstruction, LineData:
+			for _, m := range identifierRe.FindAllStringIndex(l.Text, -1) {
+				if sym := find(l.Text[m[0]:m[1]]); sym != nil && isName(l.Text, m[0]) {
+					if n := len(sym.Refs); n == 0 || sym.Refs[n-1] != l.Address {
+						sym.Refs = append(sym.Refs, l.Address)
+					}
+				}
+			}
+			if sym := find(l.Symbol); l.Instruction.Call && sym != nil && sym.Kind == SymbolLabel && !seen[sym] {
+				seen[sym] = true
+				subroutines = append(subroutines, htmlIndexEntry{sym.ID, sym.Name})
+			}
+		}
+	}
+
+	var out []htmlLine
+	anchored := make(map[uint]bool)
+	ids := make(map[string]bool)
+	for i, l := range lines {
+		find := lookup(l.Address)
+		var hl htmlLine
+		text := formatLine(dl, l)
+		switch l.Kind {
+		case LineLabel:
+			hl.Class = "label"
+			hl.HTML = template.HTML(html.EscapeString(text))
+		case LineComment:
+			hl.Class = "comment"
+			hl.HTML = template.HTML(html.EscapeString(text))
+		case LineDirective:
+			hl.Class = "directive"
+			hl.HTML = linkSymbols(l.Text, find, defined[i])
+		case LineBlank:
+			hl.Class = "blank"
+		case LineInstruction, LineData:
+			hl.Class = "code"
+			if l.Kind == LineData {
+				hl.Class = "data data-" + l.Region.String()
+			}
+			if !anchored[l.Address] {
+				anchored[l.Address] = true
+				hl.ID = fmt.Sprintf("a%04X", l.Address)
+			}
+			// The source is linked and the comment after it is plain text
+			source := " " + l.Text
+			hl.HTML = linkSymbols(source, find, nil) +
+				template.HTML(`<span class="comment">`+html.EscapeString(strings.TrimPrefix(text, source))+`</span>`)
+		}
+
+		// An OS call and a variable can share an address
+		if sym, ok := defined[i]; ok && !ids[sym.ID] {
+			ids[sym.ID] = true
+			hl.ID = sym.ID
+			hl.HTML += xrefHTML(dl, sym)
+		}
+		out = append(out, hl)
+	}
+
+	data := struct {
+		Title       string
+		Lines       []htmlLine
+		Subroutines []htmlIndexEntry
+		Labels      []htmlIndexEntry
+	}{title, out, subroutines, labels}
+	return htmlTemplate.Execute(w, data)
+}
+
+// htmlSymbol returns the symbol a name written at addr refers to, from the
+// symbols with that name. A local label is only visible in the scope of its
+// subroutine, where it hides any other symbol with the name.
+func (d *Disassembler) htmlSymbol(syms []*htmlSymbol, addr uint) *htmlSymbol {
+	var global *htmlSymbol
+	for _, sym := range syms {
+		if _, ok := d.qualifiedLabels[sym.Addr]; !ok {
+			global = sym
+		} else if d.scopeOf(sym.Addr) == d.scopeOf(addr) {
+			return sym
+		}
+	}
+	return global
+}
+
+// scopeOf returns the scoped subroutine holding addr, or nil if there is none
+func (d *Disassembler) scopeOf(addr uint) *subroutine {
+	for _, sub := range d.subroutines {
+		if sub.scoped && addr >= sub.entry && addr < sub.end {
+			return sub
+		}
+	}
+	return nil
+}
+
+// linkSymbols returns text as HTML with the symbols named in it, found with
+// lookup, linked to their definitions, except for the symbol the text defines
+func linkSymbols(text string, lookup func(string) *htmlSymbol, defines *htmlSymbol) template.HTML {
+	var sb strings.Builder
+	last := 0
+	for _, m := range identifierRe.FindAllStringIndex(text, -1) {
+		name := text[m[0]:m[1]]
+		sym := lookup(name)
+		if sym == nil || sym == defines || !isName(text, m[0]) {
+			continue
+		}
+		sb.WriteString(html.EscapeString(text[last:m[0]]))
+		fmt.Fprintf(&sb, `<a href="#%s" title="%s">%s</a>`, sym.ID, html.EscapeString(sym.Title), name)
+		last = m[1]
+	}
+	sb.WriteString(html.EscapeString(text[last:]))
+	return template.HTML(sb.String())
+}
+
+// definedName returns the first name in a directive, the symbol it defines
+// if it is an assignment
+func definedName(text string) (string, bool) {
+	for _, m := range identifierRe.FindAllStringIndex(text, -1) {
+		if isName(text, m[0]) {
+			return text[m[0]:m[1]], true
+		}
+	}
+	return "", false
+}
+
+// isName is false if the identifier at text[i] is a directive, e.g. .byte, or
+// the digits of a number, e.g. &FF
+func isName(text string, i int) bool {
+	return i == 0 || !strings.ContainsRune(".!$&%", rune(text[i-1]))
+}
+
+// xrefHTML returns the list of references to a symbol, as a comment linking
+// to each of them
+func xrefHTML(dl Dialect, sym *htmlSymbol) template.HTML {
+	if sym == nil || len(sym.Refs) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `  <span class="xref">%s refs:`, html.EscapeString(dl.Comment()))
+	for _, addr := range sym.Refs {
+		fmt.Fprintf(&sb, ` <a href="#a%04X">%s</a>`, addr, html.EscapeString(dl.Hex(addr, 4)))
+	}
+	sb.WriteString("</span>")
+	return template.HTML(sb.String())
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{ .Title }}</title>
+<style>
+body { margin: 0; font-family: sans-serif; background: #fdfdf8; color: #222; }
+nav { position: fixed; top: 0; bottom: 0; left: 0; width: 14em; overflow-y: auto; padding: 0.5em 1em; background: #eeeee4; border-right: 1px solid #ccc; }
+nav h2 { font-size: 1em; margin: 1em 0 0.3em; }
+nav ul { list-style: none; margin: 0; padding: 0; font-family: monospace; }
+nav a { text-decoration: none; color: #124; }
+main { margin-left: 16em; padding: 0.5em 1em; }
+h1 { font-size: 1.2em; }
+.listing { font-family: monospace; font-size: 0.9em; line-height: 1.35; white-space: pre; }
+.listing div { padding: 0 0.3em; min-height: 1.35em; }
+.listing a { color: #0645ad; text-decoration: none; }
+.listing a:hover { text-decoration: underline; }
+:target { background: #ffef9e !important; }
+.label { color: #7a2e00; font-weight: bold; }
+.comment, .xref { color: #6a737d; }
+.xref a { color: #6a737d; }
+.directive { color: #5a3d91; }
+.code { background: #ffffff; }
+.data { background: #eef6ff; }
+.data-unknown { background: #ffeaea; }
+.data-string { background: #eefbe9; }
+.data-words, .data-pointers, .data-pointers-lo, .data-pointers-hi { background: #f4eeff; }
+</style>
+</head>
+<body>
+<nav>
+<h2>Subroutines</h2>
+<ul>
+{{- range .Subroutines }}
+<li><a href="#{{ .ID }}">{{ .Name }}</a></li>
+{{- end }}
+</ul>
+<h2>Labels</h2>
+<ul>
+{{- range .Labels }}
+<li><a href="#{{ .ID }}">{{ .Name }}</a></li>
+{{- end }}
+</ul>
+</nav>
+<main>
+<h1>{{ .Title }}</h1>
+<div class="listing">
+{{- range .Lines }}
+<div{{ if .ID }} id="{{ .ID }}"{{ end }} class="{{ .Class }}">{{ .HTML }}</div>
+{{- end }}
+</div>
+</main>
+</body>
+</html>
+`))
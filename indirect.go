@@ -0,0 +1,158 @@
+package bbcdisasm
+
+// resolveIndirect finds the targets of indirect jumps, making them entry
+// points and returning true if any new ones were found. Targets declared in
+// IndirectTargets are always used. With ResolveIndirect the targets are also
+// found from
+//  - the pointer of JMP (ptr), if it is inside the program
+//  - constants stored to the pointer, LDA #lo : STA ptr : LDA #hi : STA ptr+1
+//  - constants stored to an OS vector, which is how handlers are installed
+//  - the table of a 65C02 JMP (table,X)
+func (d *Disassembler) resolveIndirect() bool {
+	found := false
+	addEntry := func(addr uint) {
+		if addr >= d.BranchAdjust+d.Offset && addr < d.BranchAdjust+d.Offset+d.MaxBytes && !d.entryPoints[addr] {
+			d.entryPoints[addr] = true
+			found = true
+		}
+	}
+	for _, targets := range d.IndirectTargets {
+		for _, addr := range targets {
+			addEntry(addr)
+		}
+	}
+	if !d.ResolveIndirect {
+		return found
+	}
+
+	var vectors []uint
+	var insns []Instruction
+	d.walk(vtCode, func(cursor, _ uint, in Instruction, err error) int {
+		if err != nil {
+			insns = append(insns, Instruction{})
+			return 1
+		}
+		insns = append(insns, in)
+		if in.Jump {
+			switch in.Mode {
+			case Indirect:
+				vectors = append(vectors, in.Operand)
+			case AbsoluteIndirectX:
+				found = d.addJumpTable(in.Operand) || found
+			}
+		}
+		return int(in.Length())
+	}, nil)
+
+	stored := constantPointers(insns)
+	for _, ptr := range vectors {
+		for _, val := range stored[ptr] {
+			addEntry(val)
+		}
+		if d.inProgram(ptr) && d.inProgram(d.vectorHigh(ptr)) {
+			addEntry(d.tableEntry(ptr, d.vectorHigh(ptr)))
+		}
+	}
+	for ptr := range osVectorAddresses {
+		for _, val := range stored[ptr] {
+			addEntry(val)
+		}
+	}
+	return found
+}
+
+// vectorHigh returns the address JMP (ptr) reads the high byte of the target
+// from. The NMOS 6502 does not carry into the high byte of the pointer, so
+// JMP (&30FF) reads from &30FF and &3000.
+func (d *Disassembler) vectorHigh(ptr uint) uint {
+	if !d.CPU.CMOS() && ptr&0xFF == 0xFF {
+		return ptr &^ 0xFF
+	}
+	return ptr + 1
+}
+
+// addJumpTable marks the table of code addresses read by JMP (table,X) and
+// makes its entries entry points
+func (d *Disassembler) addJumpTable(table uint) bool {
+	n := d.tableExtent(table, table+1, 2*maxTableEntries) / 2
+	n = d.checkEntries(table, n, 2, 1, true)
+	if n == 0 {
+		return false
+	}
+	d.Regions.Mark(table, table+2*n, RegionPointers)
+	d.addEntryPoints(table, table+1)
+	return true
+}
+
+// constantPointers finds the 16-bit constants stored to pairs of addresses by
+// straight line code, e.g. LDA #lo : STA ptr : LDA #hi : STA ptr+1, returning
+// the constants stored to each pair by the address of its low byte.
+func constantPointers(insns []Instruction) map[uint][]uint {
+	ptrs := make(map[uint][]uint)
+	add := func(ptr, val uint) {
+		for _, v := range ptrs[ptr] {
+			if v == val {
+				return
+			}
+		}
+		ptrs[ptr] = append(ptrs[ptr], val)
+	}
+
+	regs := make(map[byte]byte)    // registers holding a known constant
+	written := make(map[uint]byte) // constants stored since the last reset
+	for _, in := range insns {
+		if in.endsSequence() {
+			regs = make(map[byte]byte)
+			written = make(map[uint]byte)
+			continue
+		}
+
+		if reg, ok := in.register("LDA", "LDX", "LDY"); ok && in.Mode == Immediate {
+			regs[reg] = byte(in.Operand)
+			continue
+		}
+
+		var val byte
+		var dest uint
+		stores := false
+		if reg, ok := in.register("STA", "STX", "STY"); ok {
+			addr, ok := in.store(reg)
+			if !ok {
+				continue
+			}
+			v, known := regs[reg]
+			if !known {
+				// The address no longer holds a known constant
+				delete(written, addr)
+				continue
+			}
+			dest, val, stores = addr, v, true
+		} else if in.Opcode.Name == "STZ" && (in.Mode == ZeroPage || in.Mode == Absolute) {
+			dest, stores = in.Operand, true
+		} else if !preservesRegisters(in.Opcode.Name) {
+			regs = make(map[byte]byte)
+		}
+		if !stores {
+			continue
+		}
+
+		written[dest] = val
+		if lo, ok := written[dest-1]; ok {
+			add(dest-1, uint(lo)|uint(val)<<8)
+		}
+		if hi, ok := written[dest+1]; ok {
+			add(dest, uint(val)|uint(hi)<<8)
+		}
+	}
+	return ptrs
+}
+
+// preservesRegisters is true for instructions that do not change A, X or Y
+func preservesRegisters(name string) bool {
+	switch name {
+	case "STA", "STX", "STY", "STZ", "CLC", "SEC", "CLD", "SED", "CLI", "SEI", "CLV",
+		"NOP", "CMP", "CPX", "CPY", "BIT", "PHA", "PHP", "PHX", "PHY":
+		return true
+	}
+	return false
+}
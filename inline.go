@@ -0,0 +1,199 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// InlineKind describes the data following a call to a subroutine that reads
+// its parameters from after the JSR, e.g. JSR print : EQUS "Hello", 0
+type InlineKind int
+
+// Inline Kinds
+//  InlineFixed   - a fixed number of bytes
+//  InlineZero    - a string terminated by a zero byte
+//  InlineCR      - a string terminated by a carriage return
+//  InlineHighBit - a string whose last character has the top bit set
+const (
+	InlineFixed InlineKind = iota
+	InlineZero
+	InlineCR
+	InlineHighBit
+)
+
+var inlineKindNames = map[InlineKind]string{
+	InlineZero:    "zero",
+	InlineCR:      "cr",
+	InlineHighBit: "highbit",
+}
+
+// maxInlineLength limits the search for the terminator of an inline string
+const maxInlineLength = 256
+
+// InlineData describes the parameters following a call to a subroutine
+type InlineData struct {
+	Kind   InlineKind
+	Length uint // number of bytes of InlineFixed data
+}
+
+func (id InlineData) String() string {
+	if id.Kind == InlineFixed {
+		return strconv.FormatUint(uint64(id.Length), 10)
+	}
+	return inlineKindNames[id.Kind]
+}
+
+// ParseInlineData converts the description of inline data, either a number of
+// bytes or one of zero, cr or highbit for a terminated string, into an
+// InlineData.
+func ParseInlineData(s string) (InlineData, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for kind, name := range inlineKindNames {
+		if name == s {
+			return InlineData{Kind: kind}, nil
+		}
+	}
+	n, err := strconv.ParseUint(s, 0, 8)
+	if err != nil || n == 0 {
+		return InlineData{}, fmt.Errorf("invalid inline data %q, expected a length, zero, cr or highbit", s)
+	}
+	return InlineData{InlineFixed, uint(n)}, nil
+}
+
+// inlineData returns the inline data taken by the subroutine at addr, either
+// declared in Inline or found by detectInlineSubroutine.
+func (d *Disassembler) inlineData(addr uint) (InlineData, bool) {
+	if id, ok := d.Inline[addr]; ok {
+		return id, true
+	}
+	if !d.DetectInline {
+		return InlineData{}, false
+	}
+	return d.detectInlineSubroutine(addr)
+}
+
+// detectInline marks the data following calls to subroutines taking inline
+// parameters, returning true if any were found. Fixed length data is marked
+// as RegionBytes and strings as RegionString.
+func (d *Disassembler) detectInline() bool {
+	if len(d.Inline) == 0 && !d.DetectInline {
+		return false
+	}
+
+	found := false
+	d.walk(vtCode, func(cursor, _ uint, in Instruction, err error) int {
+		if err != nil {
+			return 1
+		}
+		if !in.Call {
+			return int(in.Length())
+		}
+
+		id, ok := d.inlineData(in.Target)
+		if !ok {
+			return int(in.Length())
+		}
+		start := cursor + in.Length()
+		n, ok := d.inlineLength(start, id)
+		if !ok || d.overlapsCodeAddr(start, start+n) {
+			return int(in.Length())
+		}
+		addr := in.Next()
+		if r := d.Regions.Lookup(addr); r.Type != RegionUnknown || r.End < addr+n {
+			return int(in.Length())
+		}
+
+		t := RegionString
+		if id.Kind == InlineFixed {
+			t = RegionBytes
+		}
+		d.Regions.Mark(addr, addr+n, t)
+		found = true
+		return int(in.Length() + n)
+	}, nil)
+	return found
+}
+
+// inlineLength returns the number of bytes of inline data at the program
+// offset start
+func (d *Disassembler) inlineLength(start uint, id InlineData) (uint, bool) {
+	end := d.Offset + d.MaxBytes
+	if end > uint(len(d.Program)) {
+		end = uint(len(d.Program))
+	}
+
+	if id.Kind == InlineFixed {
+		return id.Length, start+id.Length <= end
+	}
+	for i := start; i < end && i-start < maxInlineLength; i++ {
+		b := d.Program[i]
+		if (id.Kind == InlineZero && b == 0x00) ||
+			(id.Kind == InlineCR && b == 0x0D) ||
+			(id.Kind == InlineHighBit && b&0x80 != 0) {
+			return i + 1 - start, true
+		}
+	}
+	return 0, false
+}
+
+// detectInlineSubroutine recognizes a subroutine that reads inline data by
+// pulling its return address from the stack
+//
+//  PLA : STA ptr : PLA : STA ptr+1
+//
+// The kind of string is guessed from the rest of the subroutine: a comparison
+// with a carriage return, a BEQ on reading the terminating zero or a BMI or
+// BPL testing the top bit.
+func (d *Disassembler) detectInlineSubroutine(addr uint) (InlineData, bool) {
+	if addr < d.BranchAdjust+d.Offset {
+		return InlineData{}, false
+	}
+	cursor := addr - d.BranchAdjust
+	end := d.Offset + d.MaxBytes
+	if end > uint(len(d.Program)) {
+		end = uint(len(d.Program))
+	}
+
+	var insns []Instruction
+	for len(insns) < 40 && cursor < end {
+		in, err := d.CPU.Decode(d.Program[cursor:end], cursor+d.BranchAdjust)
+		if err != nil {
+			break
+		}
+		insns = append(insns, in)
+		if in.Return || (in.Jump && in.HasTarget) {
+			break
+		}
+		cursor += in.Length()
+	}
+
+	// The prologue saves the return address
+	if len(insns) < 4 || insns[0].Opcode.Name != "PLA" || insns[2].Opcode.Name != "PLA" {
+		return InlineData{}, false
+	}
+	lo, ok1 := insns[1].store('A')
+	hi, ok2 := insns[3].store('A')
+	if !ok1 || !ok2 || hi != lo+1 {
+		return InlineData{}, false
+	}
+
+	kind := InlineZero
+	var cr, zero, top bool
+	for _, in := range insns[4:] {
+		switch name := in.Opcode.Name; {
+		case name == "CMP" && in.Mode == Immediate && in.Operand == 0x0D:
+			cr = true
+		case name == "BEQ":
+			zero = true
+		case name == "BMI" || name == "BPL":
+			top = true
+		}
+	}
+	if cr {
+		kind = InlineCR
+	} else if top && !zero {
+		kind = InlineHighBit
+	}
+	return InlineData{Kind: kind}, true
+}
@@ -0,0 +1,120 @@
+package bbcdisasm
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors returned by Decode
+var (
+	ErrNoBytes       = errors.New("no bytes to decode")
+	ErrUnknownOpcode = errors.New("unknown opcode")
+	ErrTruncated     = errors.New("truncated instruction")
+)
+
+// Instruction is a decoded 6502 instruction
+type Instruction struct {
+	Address uint   // address of the opcode byte
+	Bytes   []byte // opcode and operand bytes, a slice of the decoded program
+	Opcode  Opcode
+	Mode    AddressingMode
+
+	// Operand is the value of the operand bytes: an immediate value, an
+	// address or the relative offset of a branch. For the Rockwell BBR and BBS
+	// instructions it is the zero page address.
+	Operand uint
+
+	// Target is the branch or jump destination, or the memory address the
+	// instruction accesses before indexing. HasTarget is false for implied,
+	// accumulator and immediate addressing and for indirect jumps, whose
+	// destination is not known.
+	Target    uint
+	HasTarget bool
+
+	Branch bool // a relative branch, including BRA, BBR and BBS
+	Jump   bool // JMP in any addressing mode
+	Call   bool // JSR
+	Return bool // RTS or RTI
+
+	Undocumented bool // not an official instruction, see Opcode.Stability
+	WillAssemble bool // beebasm assembles the instruction to the same bytes, never if undocumented
+}
+
+// Length returns the number of bytes in the instruction
+func (in Instruction) Length() uint {
+	return uint(len(in.Bytes))
+}
+
+// Next returns the address of the following instruction
+func (in Instruction) Next() uint {
+	return in.Address + in.Length()
+}
+
+// Decode decodes the NMOS 6502 instruction at the start of program, which is
+// located at address pc. See CPU.Decode.
+func Decode(program []byte, pc uint) (Instruction, error) {
+	return CPU6502.Decode(program, pc)
+}
+
+// Decode decodes the instruction at the start of program, which is located at
+// address pc. If the bytes do not form a whole instruction then the error is
+// ErrUnknownOpcode or ErrTruncated and the returned Instruction holds the
+// address and the available bytes.
+func (c CPU) Decode(program []byte, pc uint) (Instruction, error) {
+	if len(program) == 0 {
+		return Instruction{Address: pc}, ErrNoBytes
+	}
+
+	op, ok := c.Opcodes()[program[0]]
+	if !ok {
+		return Instruction{Address: pc, Bytes: program[:1]}, ErrUnknownOpcode
+	}
+	if uint(len(program)) < op.Length {
+		return Instruction{Address: pc, Bytes: program, Opcode: op, Mode: op.AddrMode}, ErrTruncated
+	}
+
+	bytes := program[:op.Length]
+	in := Instruction{
+		Address:      pc,
+		Bytes:        bytes,
+		Opcode:       op,
+		Mode:         op.AddrMode,
+		Undocumented: op.Undocumented(),
+		WillAssemble: !op.Undocumented() && isPreferredOpcode(op) && willAssembleIdentically(op, bytes),
+	}
+	switch op.Length {
+	case 2:
+		in.Operand = uint(bytes[1])
+	case 3:
+		in.Operand = (uint(bytes[2]) << 8) + uint(bytes[1])
+	}
+	if op.AddrMode == ZeroPageRelative {
+		in.Operand = uint(bytes[1])
+	}
+
+	switch op.branchOrJump() {
+	case btBranch:
+		in.Branch = true
+		in.Target = (pc + uint(branchOffset(bytes))) & 0xFFFF
+		in.HasTarget = true
+	case btJump:
+		in.Jump = op.Name == "JMP"
+		in.Call = op.Name == "JSR"
+		in.Target, in.HasTarget = in.Operand, op.AddrMode == Absolute
+	default:
+		in.Return = op.Name == "RTS" || op.Name == "RTI"
+		in.Target, in.HasTarget = operandAddress(op, bytes)
+	}
+	return in, nil
+}
+
+// String returns the instruction in beebasm syntax. OS calls and vectors are
+// named and other addresses are in hexadecimal. It is empty for an
+// instruction that could not be decoded.
+func (in Instruction) String() string {
+	if in.Opcode.Length == 0 || in.Length() != in.Opcode.Length {
+		return ""
+	}
+	var d Disassembler
+	return strings.TrimSpace(in.Opcode.Name + " " + d.operandText(in))
+}
@@ -0,0 +1,33 @@
+package bbcdisasm
+
+import "testing"
+
+func TestDecodeWillAssemble(t *testing.T) {
+	tests := []struct {
+		cpu   CPU
+		bytes []byte
+		want  bool
+	}{
+		{CPU6502, []byte{0xA9, 0x00}, true},        // LDA #&00
+		{CPU6502, []byte{0xAD, 0x34, 0x12}, true},  // LDA &1234
+		{CPU6502, []byte{0xAD, 0x12, 0x00}, false}, // LDA &0012 assembles as zero page
+		{CPU6502, []byte{0xAF, 0x34, 0x12}, false}, // LAX &1234
+		{CPU6502, []byte{0x1A}, false},             // undocumented NOP
+		{CPU6502, []byte{0x04, 0x10}, false},       // undocumented NOP &10
+		{CPU6502, []byte{0x02}, false},             // KIL
+		{CPU6502, []byte{0xEA}, true},              // NOP
+		{CPU65C02, []byte{0x1A}, true},             // INC A
+		{CPU65C02, []byte{0x64, 0x70}, true},       // STZ &70
+		{CPU65C02, []byte{0x02, 0x00}, false},      // 65C02 NOP
+	}
+	for _, tt := range tests {
+		in, err := tt.cpu.Decode(tt.bytes, 0x1900)
+		if err != nil {
+			t.Errorf("%v % X: %v", tt.cpu, tt.bytes, err)
+			continue
+		}
+		if in.WillAssemble != tt.want {
+			t.Errorf("%v % X (%s): WillAssemble is %v, want %v", tt.cpu, tt.bytes, in.Opcode.Name, in.WillAssemble, tt.want)
+		}
+	}
+}
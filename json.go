@@ -0,0 +1,196 @@
+package bbcdisasm
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// JSONVersion is the version of the schema written by WriteJSON. It changes
+// only when fields are removed or their meaning changes.
+const JSONVersion = 1
+
+// Line classes in the JSON disassembly
+const (
+	classCode         = "code"
+	classData         = "data"
+	classUndocumented = "undocumented"
+)
+
+type jsonDisassembly struct {
+	Version int          `json:"version"`
+	Header  jsonHeader   `json:"header"`
+	Symbols []jsonSymbol `json:"symbols"`
+	Regions []jsonRegion `json:"regions"`
+	XRefs   []jsonXRef   `json:"xrefs"`
+	Lines   []jsonLine   `json:"lines"`
+}
+
+type jsonHeader struct {
+	LoadAddress uint   `json:"load_address"`
+	Offset      uint   `json:"offset"`
+	Length      uint   `json:"length"`
+	Start       uint   `json:"start"`
+	End         uint   `json:"end"`
+	CPU         string `json:"cpu"`
+	Dialect     string `json:"dialect"`
+}
+
+type jsonRegion struct {
+	Start   uint       `json:"start"`
+	End     uint       `json:"end"`
+	Type    RegionType `json:"type"`
+	Partner *uint      `json:"partner,omitempty"`
+}
+
+type jsonXRef struct {
+	Address uint   `json:"address"`
+	From    uint   `json:"from"`
+	Access  Access `json:"access"`
+}
+
+type jsonLine struct {
+	Kind        LineKind    `json:"kind"`
+	Address     uint        `json:"address"`
+	Bytes       []int       `json:"bytes,omitempty"`
+	Text        string      `json:"text,omitempty"`
+	Class       string      `json:"class,omitempty"`
+	Mnemonic    string      `json:"mnemonic,omitempty"`
+	Operand     string      `json:"operand,omitempty"`
+	Value       *uint       `json:"value,omitempty"`
+	Target      *uint       `json:"target,omitempty"`
+	TargetLabel string      `json:"target_label,omitempty"`
+	Stability   *Stability  `json:"stability,omitempty"`
+	Region      *RegionType `json:"region,omitempty"`
+	Note        string      `json:"note,omitempty"`
+	Comment     string      `json:"comment,omitempty"`
+}
+
+// WriteJSON writes the disassembly as a JSON object, for tools that analyze
+// it. Addresses and values are numbers. The object has the fields
+//  version - JSONVersion
+//  header  - load_address, offset, length, start and end (the first address
+//            and the one after the last), cpu and dialect
+//  symbols - the symbol table, as written by WriteJSONSymbols
+//  regions - the regions after detection, each with start, end (exclusive),
+//            type and the partner of split tables
+//  xrefs   - the cross references, see XRefs, each with the address, the
+//            instruction referring to it as from and the access
+//  lines   - the lines of the disassembly in order, see below
+//
+// Each line has a kind, see LineKind, and an address. Instruction and data
+// lines have the bytes as an array of numbers and the text of the source
+// without the comment, as do the other lines the text of the label, comment
+// or directive. Instruction and data lines have a class
+//  code         - a documented instruction
+//  data         - data, from a data region or bytes that are not written as
+//                 an instruction, e.g. one straddling a label
+//  undocumented - an undocumented instruction, written as an instruction or
+//                 as data depending on the dialect
+// Instructions, including undocumented ones written as data, have the
+// mnemonic, the operand text, the operand value, which for BBR and BBS is the
+// zero page address tested, the target address of branches, jumps and memory
+// accesses, the name of the target as target_label and the stability of
+// undocumented ones. Data lines in a data
+// region have the region type. Lines with a note or user comment include
+// them.
+func (d *Disassembler) WriteJSON(w io.Writer) error {
+	out := jsonDisassembly{
+		Version: JSONVersion,
+		Header: jsonHeader{
+			LoadAddress: d.BranchAdjust,
+			Offset:      d.Offset,
+			Length:      d.MaxBytes,
+			Start:       d.BranchAdjust + d.Offset,
+			End:         d.BranchAdjust + d.Offset + d.MaxBytes,
+			CPU:         d.CPU.String(),
+			Dialect:     d.dialect().Name(),
+		},
+		Regions: []jsonRegion{},
+		XRefs:   []jsonXRef{},
+		Lines:   []jsonLine{},
+	}
+
+	err := d.Lines(func(l Line) bool {
+		out.Lines = append(out.Lines, d.jsonLine(l))
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	out.Symbols = jsonSymbols(d.Symbols())
+	for _, r := range d.Regions.Regions() {
+		jr := jsonRegion{Start: r.Start, End: r.End, Type: r.Type}
+		if r.Type == RegionPointersLo || r.Type == RegionPointersHi {
+			partner := r.Partner
+			jr.Partner = &partner
+		}
+		out.Regions = append(out.Regions, jr)
+	}
+	for _, x := range d.XRefs() {
+		out.XRefs = append(out.XRefs, jsonXRef{x.Addr, x.From, x.Access})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// jsonLine returns the JSON record of a line
+func (d *Disassembler) jsonLine(l Line) jsonLine {
+	jl := jsonLine{
+		Kind:    l.Kind,
+		Address: l.Address,
+		Text:    l.Text,
+		Note:    l.Note,
+		Comment: l.Comment,
+	}
+	for _, b := range l.Bytes {
+		jl.Bytes = append(jl.Bytes, int(b))
+	}
+
+	in, operand := l.Instruction, l.Operand
+	switch l.Kind {
+	case LineInstruction:
+		jl.Class = classCode
+	case LineData:
+		jl.Class = classData
+		if l.Region.isData() {
+			region := l.Region
+			jl.Region = &region
+			return jl
+		}
+
+		// Bytes outside data regions may be an instruction the dialect does
+		// not support
+		var err error
+		if in, err = d.CPU.Decode(l.Bytes, l.Address); err != nil || in.Length() != uint(len(l.Bytes)) {
+			return jl
+		}
+		operand = d.operandText(in)
+	default:
+		return jl
+	}
+
+	if in.Undocumented {
+		jl.Class = classUndocumented
+		stability := in.Opcode.Stability
+		jl.Stability = &stability
+	}
+	if in.Opcode.Length == 0 {
+		return jl
+	}
+	jl.Mnemonic = in.Opcode.Name
+	jl.Operand = operand
+	if in.Length() > 1 && (!in.Branch || in.Mode == ZeroPageRelative) {
+		value := in.Operand
+		jl.Value = &value
+	}
+	if in.HasTarget {
+		target := in.Target
+		jl.Target = &target
+		jl.TargetLabel, _ = d.symbolName(in)
+	}
+	return jl
+}
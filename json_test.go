@@ -0,0 +1,47 @@
+package bbcdisasm
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONBitBranchValue(t *testing.T) {
+	program := []byte{
+		0x0F, 0x70, 0x01, // BBR0 &70, skip
+		0x60, // RTS
+		0x60, // .skip RTS
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.CPU = CPUR65C02
+	var sb strings.Builder
+	if err := d.WriteJSON(&sb); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var out struct {
+		Lines []struct {
+			Mnemonic string
+			Value    *uint
+			Target   *uint
+		}
+	}
+	if err := json.Unmarshal([]byte(sb.String()), &out); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	for _, l := range out.Lines {
+		if l.Mnemonic != "BBR0" {
+			continue
+		}
+		if l.Value == nil || *l.Value != 0x70 {
+			t.Errorf("BBR0 value is %v, want &70", l.Value)
+		}
+		if l.Target == nil || *l.Target != 0x1904 {
+			t.Errorf("BBR0 target is %v, want &1904", l.Target)
+		}
+		return
+	}
+	t.Errorf("no BBR0 line in\n%s", sb.String())
+}
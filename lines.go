@@ -0,0 +1,406 @@
+package bbcdisasm
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// LineKind describes what a line of the disassembly holds
+type LineKind int
+
+// Line Kinds
+//  LineLabel       - a label, .label_0
+//  LineInstruction - an instruction, LDA #&00
+//  LineData        - data, EQUB &00
+//  LineComment     - a whole line comment, \ Clear the screen
+//  LineDirective   - an assembler directive or definition, ORG CODE%
+//  LineBlank       - an empty line
+const (
+	LineLabel LineKind = iota
+	LineInstruction
+	LineData
+	LineComment
+	LineDirective
+	LineBlank
+)
+
+var lineKindNames = []string{"label", "instruction", "data", "comment", "directive", "blank"}
+
+func (k LineKind) String() string {
+	if int(k) < len(lineKindNames) {
+		return lineKindNames[k]
+	}
+	return fmt.Sprintf("LineKind(%d)", int(k))
+}
+
+// MarshalText encodes the kind as its name
+func (k LineKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Line is a line of the disassembly
+type Line struct {
+	Kind LineKind
+
+	// Address is the address of the bytes of an instruction or data line, or
+	// the address a label or comment belongs to. It is zero for the lines
+	// before the program.
+	Address uint
+	Bytes   []byte
+
+	// Text is the assembler source of the line without any comment: the name
+	// of a label, the instruction, the data directive, the directive or the
+	// text of a comment.
+	Text string
+
+	// Instruction lines only
+	Instruction Instruction
+	Operand     string // operand as written, with names for known addresses
+	Symbol      string // name of the address the operand refers to, if any
+
+	// Data lines only. Region is the type of the data region the bytes belong
+	// to, or RegionUnknown for bytes that could not be written as an
+	// instruction. Note describes such bytes, e.g. UD SRE for an undocumented
+	// instruction.
+	Region RegionType
+	Note   string
+
+	// Comment is the user comment for an instruction or data line, or the
+	// cross references of a label
+	Comment string
+}
+
+// Lines disassembles the program, calling fn with each line of the output in
+// order until fn returns false. The labels and symbols in the lines are
+// resolved before the first line is produced. The header and footer of the
+// Dialect come before and after the program, the footer following the table
+// of CrossReferences if there is one. An error is returned if the range to
+// disassemble is not inside the program.
+func (d *Disassembler) Lines(fn func(Line) bool) error {
+	if err := d.checkRange(); err != nil {
+		return err
+	}
+
+	d.codeAddrs = make([]uint, len(d.CodeAddrs))
+	for i, ca := range d.CodeAddrs {
+		d.codeAddrs[i] = ca - d.BranchAdjust
+	}
+	sort.Slice(d.codeAddrs, func(i, j int) bool { return d.codeAddrs[i] < d.codeAddrs[j] })
+
+	// First pass through program is to find the location of any branches. These
+	// will be marked as labels in the output.
+	d.analyze()
+
+	header, err := d.headerLines()
+	if err != nil {
+		return err
+	}
+	for _, l := range header {
+		if !fn(l) {
+			return nil
+		}
+	}
+
+	// Second pass through program is to decode each instruction
+	d.openScope = nil
+	stopped := false
+	d.walk(vtAll, func(cursor, limit uint, in Instruction, err error) int {
+		l := d.codeLine(cursor, limit, in, err)
+		if !d.emitLine(fn, l) {
+			stopped = true
+			return -1
+		}
+		return len(l.Bytes)
+	}, func(cursor, limit uint, r Region) int {
+		text, n := d.regionData(cursor, limit, r)
+		l := Line{
+			Kind:    LineData,
+			Address: cursor + d.BranchAdjust,
+			Bytes:   d.Program[cursor : cursor+n],
+			Text:    text,
+			Region:  r.Type,
+		}
+		if !d.emitLine(fn, l) {
+			stopped = true
+			return -1
+		}
+		return int(n)
+	})
+	if stopped || !d.closeScope(fn, ^uint(0)) {
+		return nil
+	}
+
+	footer, err := d.templateLines("footer", d.dialect().Footer())
+	if err != nil {
+		return err
+	}
+	for _, l := range append(d.xrefTableLines(), footer...) {
+		if !fn(l) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// headerLines returns the lines before the program: the definitions of the
+// OS calls, vectors and variables used and the directives to assemble at the
+// load address.
+func (d *Disassembler) headerLines() ([]Line, error) {
+	return d.templateLines("header", d.dialect().Header())
+}
+
+// templateLines returns the lines of a header or footer template of the
+// dialect. The template is executed with the OS calls, vectors and variables
+// used, the load address and Offset, the start address Start, the CPU and
+// whether undocumented instructions are written natively. It can use the
+// templates in headerTemplates and the functions
+//  comment - the characters starting a comment
+//  hex     - a number in hexadecimal
+//  assign  - the definition of a symbol, from the name and value
+//  symbol  - the name of an OS call or vector as written
+func (d *Disassembler) templateLines(name, text string) ([]Line, error) {
+	dl := d.dialect()
+	funcs := template.FuncMap{
+		"comment": dl.Comment,
+		"hex":     func(val uint) string { return dl.Hex(val, 0) },
+		"assign":  dl.Assign,
+		"symbol":  dl.Symbol,
+	}
+	distem, err := template.New(name).Funcs(funcs).Parse(headerTemplates)
+	if err == nil {
+		distem, err = distem.Parse(text)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Variables are written as given unless the dialect has a different
+	// syntax for hexadecimal
+	vars := make(map[string]string)
+	for name, def := range d.headerVars() {
+		vars[name] = def.Sval
+		if strings.HasPrefix(def.Sval, "&") && !strings.HasPrefix(dl.Hex(0, 0), "&") {
+			vars[name] = dl.Hex(def.Ival, len(def.Sval)-1)
+		}
+	}
+	data := struct {
+		UsedOSAddress map[uint]bool
+		OSAddress     map[uint]string
+		UsedOSVector  map[uint]bool
+		OSVector      map[uint]string
+		Vars          map[string]string
+		LoadAddr      uint
+		Offset        uint
+		Start         uint
+		CPU           CPU
+		CMOS          bool
+		Undocumented  bool
+	}{d.usedOSAddress, addressToOsCallName, d.usedOSVector, osVectorAddresses, vars, d.BranchAdjust, d.Offset,
+		d.BranchAdjust + d.Offset, d.CPU, d.CPU.CMOS(), !d.CPU.CMOS() && dl.Undocumented() != NoSupport}
+	var buf bytes.Buffer
+	if err := distem.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return nil, nil
+	}
+
+	var lines []Line
+	for _, text := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		switch {
+		case text == "":
+			lines = append(lines, Line{Kind: LineBlank})
+		case strings.HasPrefix(text, dl.Comment()):
+			lines = append(lines, Line{Kind: LineComment, Text: strings.TrimPrefix(text[len(dl.Comment()):], " ")})
+		default:
+			lines = append(lines, Line{Kind: LineDirective, Text: text})
+		}
+	}
+	return lines, nil
+}
+
+// codeLine returns the line for the bytes at cursor outside any data region,
+// an instruction or, if the bytes cannot be written as one, data.
+func (d *Disassembler) codeLine(cursor, limit uint, in Instruction, err error) Line {
+	address := cursor + d.BranchAdjust
+
+	// Situations that can arise decoding the next instruction
+	// 1) If the byte does not match an opcode - print as data
+	// 2) If the byte matches a documented opcode:
+	//    a) If the instruction won't assemble identically then print as
+	//       data.
+	//    b) If the instruction straddles a boundary (a targeted code
+	//       address or the edge of a region) then print as data the bytes
+	//       up to the boundary.
+	//    c) Otherwise, decode operands and print.
+	// 3) If the byte matches an undocumented opcode:
+	//    a) If the instruction straddles a boundary then print as data the
+	//       bytes up to the boundary.
+	//    b) Otherwise retrieve operands, print as data, mark UD
+	if err != nil {
+		bs := d.Program[cursor : cursor+1]
+		if err == ErrTruncated {
+			// The last bytes of the program are the start of an instruction,
+			// keep them together
+			bs = in.Bytes
+			if cursor+uint(len(bs)) > limit {
+				bs = bs[:limit-cursor]
+			}
+		}
+		return Line{Kind: LineData, Address: address, Bytes: bs, Text: d.dataBytes(bs)}
+	}
+
+	op := in.Opcode
+	doc := !in.Undocumented
+	straddles := cursor+in.Length() > limit
+
+	// Undocumented instructions are written natively by the dialects that
+	// support them, except for the 65C02 whose unused opcodes are NOPs
+	name, native := op.Name, doc
+	if !doc && !d.CPU.CMOS() {
+		name, native = d.dialect().UndocumentedName(op)
+	}
+
+	if native && !straddles && !op.isBitInstruction() {
+		// If here then an instruction that will assemble correctly, unless it
+		// is an absolute instruction addressing zero page. Those are assembled
+		// with zero page addressing unless the dialect can force absolute
+		// addressing.
+		operand, ok := d.Operands[address]
+		if !ok {
+			operand = d.operandText(in)
+		}
+		text, ok := strings.TrimSpace(name+" "+operand), true
+		if !willAssembleIdentically(op, in.Bytes) {
+			text, ok = d.dialect().ForceAbsolute(name, operand)
+		}
+		if ok {
+			symbol, _ := d.symbolName(in)
+			return Line{
+				Kind:        LineInstruction,
+				Address:     address,
+				Bytes:       in.Bytes,
+				Text:        text,
+				Instruction: in,
+				Operand:     operand,
+				Symbol:      symbol,
+			}
+		}
+	}
+
+	// The opcode was unrecognized, the opcode belongs to an undocumented
+	// instruction the dialect does not support, the instruction will straddle
+	// a boundary or the assembler will not assemble to the same bytes. In
+	// these cases treat it as data.
+
+	// If the data block straddles a boundary then trim to it.
+	bs := in.Bytes
+	if straddles {
+		bs = bs[:limit-cursor]
+	}
+	l := Line{Kind: LineData, Address: address, Bytes: bs, Text: d.dataBytes(bs)}
+
+	// Data bytes are included in the comment section for visual consistency
+	// if the instruction is documented. Non documented and bit manipulation
+	// instructions have a note instead.
+	if op.isBitInstruction() && !straddles {
+		// beebasm does not support the instruction so include the
+		// disassembly as a comment
+		l.Note = op.Name + " " + d.operandText(in)
+	} else if !doc {
+		l.Note = "UD " + op.Name
+		if op.Stability == Unstable || op.Stability == Magic {
+			// Flag instructions that cannot be relied upon
+			l.Note += " " + op.Stability.String()
+		}
+	}
+	return l
+}
+
+// emitLine calls fn with the block comments and the label for l, then l with
+// its inline comments. Subroutines also have a header before and their scope
+// opened after the label. It returns false if fn does.
+func (d *Disassembler) emitLine(fn func(Line) bool, l Line) bool {
+	if !d.closeScope(fn, l.Address) {
+		return false
+	}
+	sub := d.subroutines[l.Address]
+	if sub != nil {
+		for _, hl := range d.subroutineHeader(sub) {
+			if !fn(hl) {
+				return false
+			}
+		}
+	}
+
+	length := uint(len(l.Bytes))
+	for i := uint(0); i < length; i++ {
+		if text, ok := d.BlockComments[l.Address+i]; ok {
+			for _, c := range strings.Split(text, "\n") {
+				if !fn(Line{Kind: LineComment, Address: l.Address + i, Text: c}) {
+					return false
+				}
+			}
+		}
+	}
+	if name, ok := d.labelName(l.Address); ok {
+		if !fn(Line{Kind: LineLabel, Address: l.Address, Text: name, Comment: d.labelXRefs(l.Address)}) {
+			return false
+		}
+	}
+	if sub != nil && sub.scoped {
+		open, _, _ := d.dialect().Scope()
+		if !fn(Line{Kind: LineDirective, Address: l.Address, Text: open}) {
+			return false
+		}
+		d.openScope = sub
+	}
+
+	var comments []string
+	for i := uint(0); i < length; i++ {
+		if text, ok := d.Comments[l.Address+i]; ok {
+			comments = append(comments, strings.ReplaceAll(text, "\n", " "))
+		}
+	}
+	l.Comment = strings.Join(comments, "  ")
+	return fn(l)
+}
+
+// closeScope calls fn with the directive closing the scope of a subroutine
+// if one is open and addr is past its end. It returns false if fn does.
+func (d *Disassembler) closeScope(fn func(Line) bool, addr uint) bool {
+	if d.openScope == nil || addr < d.openScope.end {
+		return true
+	}
+	_, directive, _ := d.dialect().Scope()
+	end := d.openScope.end
+	d.openScope = nil
+	return fn(Line{Kind: LineDirective, Address: end, Text: directive})
+}
+
+// symbolName returns the name of the address the operand of an instruction
+// refers to, if it has one
+func (d *Disassembler) symbolName(in Instruction) (string, bool) {
+	addr := in.Target
+	if !in.HasTarget {
+		if !in.Jump {
+			return "", false
+		}
+		addr = in.Operand // the pointer of an indirect jump
+	}
+	if in.Jump || in.Call {
+		if osCall, ok := addressToOsCallName[addr]; ok {
+			return d.dialect().Symbol(osCall), true
+		}
+	}
+	if osv, ok := osVectorAddresses[addr]; ok {
+		return d.dialect().Symbol(osv), true
+	}
+	if name, ok := d.refName(addr); ok {
+		return name, true
+	}
+	return d.addrName(addr)
+}
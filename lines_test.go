@@ -0,0 +1,33 @@
+package bbcdisasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLinesTwice(t *testing.T) {
+	// A data byte that would swallow the first byte of the code at &1902
+	program := []byte{0x60, 0xAD, 0xA9, 0x00, 0x60}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.CodeAddrs = []uint{0x1902, 0x1900}
+
+	var out [2]string
+	for i := range out {
+		var sb strings.Builder
+		if err := d.Disassemble(&sb); err != nil {
+			t.Fatalf("Disassemble: %v", err)
+		}
+		out[i] = sb.String()
+	}
+	if out[0] != out[1] {
+		t.Errorf("second disassembly differs from the first:\n%s\n%s", out[0], out[1])
+	}
+	if !strings.Contains(out[0], "LDA #&00") {
+		t.Errorf("code address &1902 is not disassembled:\n%s", out[0])
+	}
+	if d.CodeAddrs[0] != 0x1902 || d.CodeAddrs[1] != 0x1900 {
+		t.Errorf("CodeAddrs changed to %X", d.CodeAddrs)
+	}
+}
@@ -4,7 +4,10 @@ import (
 	"fmt"
 )
 
-const labelFormatString = "label_%d"
+const (
+	labelFormatString     = "label_%d"
+	dataLabelFormatString = "data_%04X"
+)
 
 // AddressingMode enumerates the different address modes of 6502 instructions
 type AddressingMode int
@@ -22,6 +25,11 @@ type AddressingMode int
 //  AbsoluteY   - using an absolute address+Y                 - LDA &1234,Y
 //  IndirectX   - a table of zero page addresses indexed by X - LDA (&80,X)
 //  IndirectY   - a table of zero page addresses indexed by Y - LDA (&80,Y)
+//
+// 65C02 only
+//  ZeroPageIndirect  - using an address stored in zero page  - LDA (&80)
+//  AbsoluteIndirectX - a table of addresses indexed by X     - JMP (&1234,X)
+//  ZeroPageRelative  - a zero page address and a branch      - BBR0 &80,label
 const (
 	None AddressingMode = iota
 	Accumulator
@@ -35,14 +43,122 @@ const (
 	AbsoluteY
 	IndirectX
 	IndirectY
+	ZeroPageIndirect
+	AbsoluteIndirectX
+	ZeroPageRelative
 )
 
+// Stability classifies an instruction as documented or, for the undocumented
+// instructions, how reliably it behaves across NMOS 6502 parts.
+type Stability int
+
+// Stabilities
+//  Documented - an official instruction
+//  Stable     - undocumented, behaves the same on all NMOS parts
+//  Unstable   - undocumented, the result depends on the high byte of the
+//               target address and breaks when indexing crosses a page
+//  Magic      - undocumented, the result depends on a 'magic' constant that
+//               varies between parts and even with temperature
+//  Jam        - undocumented, halts the CPU until reset (KIL/JAM)
+const (
+	Documented Stability = iota
+	Stable
+	Unstable
+	Magic
+	Jam
+)
+
+var stabilityNames = []string{"documented", "stable", "unstable", "magic", "jam"}
+
+func (s Stability) String() string {
+	if int(s) < len(stabilityNames) {
+		return stabilityNames[s]
+	}
+	return fmt.Sprintf("Stability(%d)", int(s))
+}
+
+// MarshalText encodes the stability as its name
+func (s Stability) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Access describes how an instruction uses the address in its operand
+type Access int
+
+// Accesses
+//  AccessNone            - no address, e.g. implied or immediate operands
+//  AccessRead            - reads the address, LDA &70
+//  AccessWrite           - writes the address, STA &70
+//  AccessReadModifyWrite - reads the address and writes it back, INC &70
+//  AccessCall            - calls a subroutine, JSR &1900
+//  AccessJump            - jumps, JMP &1900
+//  AccessBranch          - branches, BNE &1900
+//  AccessIndirect        - reads a pointer, LDA (&70),Y or JMP (&0200)
+const (
+	AccessNone Access = iota
+	AccessRead
+	AccessWrite
+	AccessReadModifyWrite
+	AccessCall
+	AccessJump
+	AccessBranch
+	AccessIndirect
+)
+
+var accessNames = []string{"none", "read", "write", "rmw", "call", "jump", "branch", "indirect"}
+
+func (a Access) String() string {
+	if int(a) < len(accessNames) {
+		return accessNames[a]
+	}
+	return fmt.Sprintf("Access(%d)", int(a))
+}
+
+// MarshalText encodes the access as its name
+func (a Access) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
 // Opcode defines a 6502 opcode
 type Opcode struct {
-	Value    byte   // Byte value for the opcode. All opcodes are one byte long.
-	Name     string // Human readable instruction 'name'
-	Length   uint   // Num bytes for instruction and arguments, includes opcode
-	AddrMode AddressingMode
+	Value     byte   // Byte value for the opcode. All opcodes are one byte long.
+	Name      string // Human readable instruction 'name'
+	Length    uint   // Num bytes for instruction and arguments, includes opcode
+	AddrMode  AddressingMode
+	Stability Stability
+}
+
+// Undocumented is true if the opcode is not an official 6502 instruction
+func (o Opcode) Undocumented() bool {
+	return o.Stability != Documented
+}
+
+// Access returns how the instruction uses the address in its operand. The
+// Rockwell BBR and BBS instructions are branches that also read their zero
+// page operand.
+func (o Opcode) Access() Access {
+	switch o.branchOrJump() {
+	case btBranch:
+		return AccessBranch
+	case btJump:
+		switch {
+		case o.Name == "JSR":
+			return AccessCall
+		case o.AddrMode != Absolute:
+			return AccessIndirect
+		}
+		return AccessJump
+	}
+	switch o.AddrMode {
+	case None, Accumulator, Immediate:
+		return AccessNone
+	case IndirectX, IndirectY, ZeroPageIndirect:
+		return AccessIndirect
+	}
+	if o.isBitInstruction() {
+		return memoryAccess[o.Name[:3]]
+	}
+	return memoryAccess[o.Name]
 }
 
 // TODO - Constants for all instructions?
@@ -53,224 +169,362 @@ const (
 )
 
 var (
-	// OpCodes defines the documented instructions of the 6502 CPU. It also
-	// includes a couple of undocumented instructions.
-	// Most opcodes from http://www.6502.org/tutorials/6502opcodes.html
-	// ANC, SLO, SRE from https://github.com/mattgodbolt/jsbeeb/blob/master/6502.opcodes.js
+	// OpCodes defines the documented instructions of the 6502 CPU.
+	// Opcodes from http://www.6502.org/tutorials/6502opcodes.html
 	OpCodes = []Opcode{
-		{0x69, "ADC", 2, Immediate},
-		{0x65, "ADC", 2, ZeroPage},
-		{0x75, "ADC", 2, ZeroPageX},
-		{0x6D, "ADC", 3, Absolute},
-		{0x7D, "ADC", 3, AbsoluteX},
-		{0x79, "ADC", 3, AbsoluteY},
-		{0x61, "ADC", 2, IndirectX},
-		{0x71, "ADC", 2, IndirectY},
-
-		{0x0B, "ANC", 2, Immediate},
-		{0x2B, "ANC", 2, Immediate},
-
-		{0x29, "AND", 2, Immediate},
-		{0x25, "AND", 2, ZeroPage},
-		{0x35, "AND", 2, ZeroPageX},
-		{0x2D, "AND", 3, Absolute},
-		{0x3D, "AND", 3, AbsoluteX},
-		{0x39, "AND", 3, AbsoluteY},
-		{0x21, "AND", 2, IndirectX},
-		{0x31, "AND", 2, IndirectY},
-
-		{0x0A, "ASL", 1, Accumulator},
-		{0x06, "ASL", 2, ZeroPage},
-		{0x16, "ASL", 2, ZeroPageX},
-		{0x0E, "ASL", 3, Absolute},
-		{0x1E, "ASL", 3, AbsoluteX},
-
-		{0x24, "BIT", 2, ZeroPage},
-		{0x2C, "BIT", 3, Absolute},
-
-		{0x10, "BPL", 2, None}, // all the branch instructions have special cased
-		{0x30, "BMI", 2, None}, // printing
-		{0x50, "BVC", 2, None},
-		{0x70, "BVS", 2, None},
-		{0x90, "BCC", 2, None},
-		{0xB0, "BCS", 2, None},
-		{0xD0, "BNE", 2, None},
-		{0xF0, "BEQ", 2, None},
-
-		{0x00, "BRK", 1, None},
-
-		{0xC9, "CMP", 2, Immediate},
-		{0xC5, "CMP", 2, ZeroPage},
-		{0xD5, "CMP", 2, ZeroPageX},
-		{0xCD, "CMP", 3, Absolute},
-		{0xDD, "CMP", 3, AbsoluteX},
-		{0xD9, "CMP", 3, AbsoluteY},
-		{0xC1, "CMP", 2, IndirectX},
-		{0xD1, "CMP", 2, IndirectY},
-
-		{0xE0, "CPX", 2, Immediate},
-		{0xE4, "CPX", 2, ZeroPage},
-		{0xEC, "CPX", 3, Absolute},
-
-		{0xC0, "CPY", 2, Immediate},
-		{0xC4, "CPY", 2, ZeroPage},
-		{0xCC, "CPY", 3, Absolute},
-
-		{0xC6, "DEC", 2, ZeroPage},
-		{0xD6, "DEC", 2, ZeroPageX},
-		{0xCE, "DEC", 3, Absolute},
-		{0xDE, "DEC", 3, AbsoluteX},
-
-		{0x49, "EOR", 2, Immediate},
-		{0x45, "EOR", 2, ZeroPage},
-		{0x55, "EOR", 2, ZeroPageX},
-		{0x4D, "EOR", 3, Absolute},
-		{0x5D, "EOR", 3, AbsoluteX},
-		{0x59, "EOR", 3, AbsoluteY},
-		{0x41, "EOR", 2, IndirectX},
-		{0x51, "EOR", 2, IndirectY},
-
-		{0x18, "CLC", 1, None},
-		{0x38, "SEC", 1, None},
-		{0x58, "CLI", 1, None},
-		{0x78, "SEI", 1, None},
-		{0xB8, "CLV", 1, None},
-		{0xD8, "CLD", 1, None},
-		{0xF8, "SED", 1, None},
-
-		{0xE6, "INC", 2, ZeroPage},
-		{0xF6, "INC", 2, ZeroPageX},
-		{0xEE, "INC", 3, Absolute},
-		{0xFE, "INC", 3, AbsoluteX},
-
-		{OpJMPAbsolute, "JMP", 3, Absolute}, // special cased when printing
-		{OpJMPIndirect, "JMP", 3, Indirect},
-
-		{OpJSRAbsolute, "JSR", 3, Absolute}, // special cased when printing
-
-		{0xA9, "LDA", 2, Immediate},
-		{0xA5, "LDA", 2, ZeroPage},
-		{0xB5, "LDA", 2, ZeroPageX},
-		{0xAD, "LDA", 3, Absolute},
-		{0xBD, "LDA", 3, AbsoluteX},
-		{0xB9, "LDA", 3, AbsoluteY},
-		{0xA1, "LDA", 2, IndirectX},
-		{0xB1, "LDA", 2, IndirectY},
-
-		{0xA2, "LDX", 2, Immediate},
-		{0xA6, "LDX", 2, ZeroPage},
-		{0xB6, "LDX", 2, ZeroPageY},
-		{0xAE, "LDX", 3, Absolute},
-		{0xBE, "LDX", 3, AbsoluteY},
-
-		{0xA0, "LDY", 2, Immediate},
-		{0xA4, "LDY", 2, ZeroPage},
-		{0xB4, "LDY", 2, ZeroPageX},
-		{0xAC, "LDY", 3, Absolute},
-		{0xBC, "LDY", 3, AbsoluteX},
-
-		{0x4A, "LSR", 1, Accumulator},
-		{0x46, "LSR", 2, ZeroPage},
-		{0x56, "LSR", 2, ZeroPageX},
-		{0x4E, "LSR", 3, Absolute},
-		{0x5E, "LSR", 3, AbsoluteX},
-
-		{0xEA, "NOP", 1, None},
-
-		{0x09, "ORA", 2, Immediate},
-		{0x05, "ORA", 2, ZeroPage},
-		{0x15, "ORA", 2, ZeroPageX},
-		{0x0D, "ORA", 3, Absolute},
-		{0x1D, "ORA", 3, AbsoluteX},
-		{0x19, "ORA", 3, AbsoluteY},
-		{0x01, "ORA", 2, IndirectX},
-		{0x11, "ORA", 2, IndirectY},
-
-		{0xAA, "TAX", 1, None},
-		{0x8A, "TXA", 1, None},
-		{0xCA, "DEX", 1, None},
-		{0xE8, "INX", 1, None},
-		{0xA8, "TAY", 1, None},
-		{0x98, "TYA", 1, None},
-		{0x88, "DEY", 1, None},
-		{0xC8, "INY", 1, None},
-
-		{0x2A, "ROL", 1, Accumulator},
-		{0x26, "ROL", 2, ZeroPage},
-		{0x36, "ROL", 2, ZeroPageX},
-		{0x2E, "ROL", 3, Absolute},
-		{0x3E, "ROL", 3, AbsoluteX},
-
-		{0x6A, "ROR", 1, Accumulator},
-		{0x66, "ROR", 2, ZeroPage},
-		{0x76, "ROR", 2, ZeroPageX},
-		{0x6E, "ROR", 3, Absolute},
-		{0x7E, "ROR", 3, AbsoluteX},
-
-		{0x40, "RTI", 1, None},
-
-		{0x60, "RTS", 1, None},
-
-		{0xE9, "SBC", 2, Immediate},
-		{0xE5, "SBC", 2, ZeroPage},
-		{0xF5, "SBC", 2, ZeroPageX},
-		{0xED, "SBC", 3, Absolute},
-		{0xFD, "SBC", 3, AbsoluteX},
-		{0xF9, "SBC", 3, AbsoluteY},
-		{0xE1, "SBC", 2, IndirectX},
-		{0xF1, "SBC", 2, IndirectY},
-
-		{0x47, "SRE", 2, ZeroPage},
-		{0x57, "SRE", 2, ZeroPageX},
-		{0x4F, "SRE", 3, Absolute},
-		{0x5F, "SRE", 3, AbsoluteX},
-		{0x5B, "SRE", 3, AbsoluteY},
-		{0x43, "SRE", 2, IndirectX},
-		{0x53, "SRE", 2, IndirectY},
-
-		{0x85, "STA", 2, ZeroPage},
-		{0x95, "STA", 2, ZeroPageX},
-		{0x8D, "STA", 3, Absolute},
-		{0x9D, "STA", 3, AbsoluteX},
-		{0x99, "STA", 3, AbsoluteY},
-		{0x81, "STA", 2, IndirectX},
-		{0x91, "STA", 2, IndirectY},
-
-		{0x9A, "TXS", 1, None},
-		{0xBA, "TSX", 1, None},
-		{0x48, "PHA", 1, None},
-		{0x68, "PLA", 1, None},
-		{0x08, "PHP", 1, None},
-		{0x28, "PLP", 1, None},
-
-		{0x07, "SLO", 2, ZeroPage},
-		{0x17, "SLO", 2, ZeroPageX},
-		{0x0F, "SLO", 3, Absolute},
-		{0x1F, "SLO", 3, AbsoluteX},
-		{0x1B, "SLO", 3, AbsoluteY},
-		{0x03, "SLO", 2, IndirectX},
-		{0x13, "SLO", 2, IndirectY},
-
-		{0x86, "STX", 2, ZeroPage},
-		{0x96, "STX", 2, ZeroPageY},
-		{0x8E, "STX", 3, Absolute},
-
-		{0x84, "STY", 2, ZeroPage},
-		{0x94, "STY", 2, ZeroPageX},
-		{0x8C, "STY", 3, Absolute},
+		{0x69, "ADC", 2, Immediate, Documented},
+		{0x65, "ADC", 2, ZeroPage, Documented},
+		{0x75, "ADC", 2, ZeroPageX, Documented},
+		{0x6D, "ADC", 3, Absolute, Documented},
+		{0x7D, "ADC", 3, AbsoluteX, Documented},
+		{0x79, "ADC", 3, AbsoluteY, Documented},
+		{0x61, "ADC", 2, IndirectX, Documented},
+		{0x71, "ADC", 2, IndirectY, Documented},
+
+		{0x29, "AND", 2, Immediate, Documented},
+		{0x25, "AND", 2, ZeroPage, Documented},
+		{0x35, "AND", 2, ZeroPageX, Documented},
+		{0x2D, "AND", 3, Absolute, Documented},
+		{0x3D, "AND", 3, AbsoluteX, Documented},
+		{0x39, "AND", 3, AbsoluteY, Documented},
+		{0x21, "AND", 2, IndirectX, Documented},
+		{0x31, "AND", 2, IndirectY, Documented},
+
+		{0x0A, "ASL", 1, Accumulator, Documented},
+		{0x06, "ASL", 2, ZeroPage, Documented},
+		{0x16, "ASL", 2, ZeroPageX, Documented},
+		{0x0E, "ASL", 3, Absolute, Documented},
+		{0x1E, "ASL", 3, AbsoluteX, Documented},
+
+		{0x24, "BIT", 2, ZeroPage, Documented},
+		{0x2C, "BIT", 3, Absolute, Documented},
+
+		{0x10, "BPL", 2, None, Documented}, // all the branch instructions have special cased
+		{0x30, "BMI", 2, None, Documented}, // printing
+		{0x50, "BVC", 2, None, Documented},
+		{0x70, "BVS", 2, None, Documented},
+		{0x90, "BCC", 2, None, Documented},
+		{0xB0, "BCS", 2, None, Documented},
+		{0xD0, "BNE", 2, None, Documented},
+		{0xF0, "BEQ", 2, None, Documented},
+
+		{0x00, "BRK", 1, None, Documented},
+
+		{0xC9, "CMP", 2, Immediate, Documented},
+		{0xC5, "CMP", 2, ZeroPage, Documented},
+		{0xD5, "CMP", 2, ZeroPageX, Documented},
+		{0xCD, "CMP", 3, Absolute, Documented},
+		{0xDD, "CMP", 3, AbsoluteX, Documented},
+		{0xD9, "CMP", 3, AbsoluteY, Documented},
+		{0xC1, "CMP", 2, IndirectX, Documented},
+		{0xD1, "CMP", 2, IndirectY, Documented},
+
+		{0xE0, "CPX", 2, Immediate, Documented},
+		{0xE4, "CPX", 2, ZeroPage, Documented},
+		{0xEC, "CPX", 3, Absolute, Documented},
+
+		{0xC0, "CPY", 2, Immediate, Documented},
+		{0xC4, "CPY", 2, ZeroPage, Documented},
+		{0xCC, "CPY", 3, Absolute, Documented},
+
+		{0xC6, "DEC", 2, ZeroPage, Documented},
+		{0xD6, "DEC", 2, ZeroPageX, Documented},
+		{0xCE, "DEC", 3, Absolute, Documented},
+		{0xDE, "DEC", 3, AbsoluteX, Documented},
+
+		{0x49, "EOR", 2, Immediate, Documented},
+		{0x45, "EOR", 2, ZeroPage, Documented},
+		{0x55, "EOR", 2, ZeroPageX, Documented},
+		{0x4D, "EOR", 3, Absolute, Documented},
+		{0x5D, "EOR", 3, AbsoluteX, Documented},
+		{0x59, "EOR", 3, AbsoluteY, Documented},
+		{0x41, "EOR", 2, IndirectX, Documented},
+		{0x51, "EOR", 2, IndirectY, Documented},
+
+		{0x18, "CLC", 1, None, Documented},
+		{0x38, "SEC", 1, None, Documented},
+		{0x58, "CLI", 1, None, Documented},
+		{0x78, "SEI", 1, None, Documented},
+		{0xB8, "CLV", 1, None, Documented},
+		{0xD8, "CLD", 1, None, Documented},
+		{0xF8, "SED", 1, None, Documented},
+
+		{0xE6, "INC", 2, ZeroPage, Documented},
+		{0xF6, "INC", 2, ZeroPageX, Documented},
+		{0xEE, "INC", 3, Absolute, Documented},
+		{0xFE, "INC", 3, AbsoluteX, Documented},
+
+		{OpJMPAbsolute, "JMP", 3, Absolute, Documented}, // special cased when printing
+		{OpJMPIndirect, "JMP", 3, Indirect, Documented},
+
+		{OpJSRAbsolute, "JSR", 3, Absolute, Documented}, // special cased when printing
+
+		{0xA9, "LDA", 2, Immediate, Documented},
+		{0xA5, "LDA", 2, ZeroPage, Documented},
+		{0xB5, "LDA", 2, ZeroPageX, Documented},
+		{0xAD, "LDA", 3, Absolute, Documented},
+		{0xBD, "LDA", 3, AbsoluteX, Documented},
+		{0xB9, "LDA", 3, AbsoluteY, Documented},
+		{0xA1, "LDA", 2, IndirectX, Documented},
+		{0xB1, "LDA", 2, IndirectY, Documented},
+
+		{0xA2, "LDX", 2, Immediate, Documented},
+		{0xA6, "LDX", 2, ZeroPage, Documented},
+		{0xB6, "LDX", 2, ZeroPageY, Documented},
+		{0xAE, "LDX", 3, Absolute, Documented},
+		{0xBE, "LDX", 3, AbsoluteY, Documented},
+
+		{0xA0, "LDY", 2, Immediate, Documented},
+		{0xA4, "LDY", 2, ZeroPage, Documented},
+		{0xB4, "LDY", 2, ZeroPageX, Documented},
+		{0xAC, "LDY", 3, Absolute, Documented},
+		{0xBC, "LDY", 3, AbsoluteX, Documented},
+
+		{0x4A, "LSR", 1, Accumulator, Documented},
+		{0x46, "LSR", 2, ZeroPage, Documented},
+		{0x56, "LSR", 2, ZeroPageX, Documented},
+		{0x4E, "LSR", 3, Absolute, Documented},
+		{0x5E, "LSR", 3, AbsoluteX, Documented},
+
+		{0xEA, "NOP", 1, None, Documented},
+
+		{0x09, "ORA", 2, Immediate, Documented},
+		{0x05, "ORA", 2, ZeroPage, Documented},
+		{0x15, "ORA", 2, ZeroPageX, Documented},
+		{0x0D, "ORA", 3, Absolute, Documented},
+		{0x1D, "ORA", 3, AbsoluteX, Documented},
+		{0x19, "ORA", 3, AbsoluteY, Documented},
+		{0x01, "ORA", 2, IndirectX, Documented},
+		{0x11, "ORA", 2, IndirectY, Documented},
+
+		{0xAA, "TAX", 1, None, Documented},
+		{0x8A, "TXA", 1, None, Documented},
+		{0xCA, "DEX", 1, None, Documented},
+		{0xE8, "INX", 1, None, Documented},
+		{0xA8, "TAY", 1, None, Documented},
+		{0x98, "TYA", 1, None, Documented},
+		{0x88, "DEY", 1, None, Documented},
+		{0xC8, "INY", 1, None, Documented},
+
+		{0x2A, "ROL", 1, Accumulator, Documented},
+		{0x26, "ROL", 2, ZeroPage, Documented},
+		{0x36, "ROL", 2, ZeroPageX, Documented},
+		{0x2E, "ROL", 3, Absolute, Documented},
+		{0x3E, "ROL", 3, AbsoluteX, Documented},
+
+		{0x6A, "ROR", 1, Accumulator, Documented},
+		{0x66, "ROR", 2, ZeroPage, Documented},
+		{0x76, "ROR", 2, ZeroPageX, Documented},
+		{0x6E, "ROR", 3, Absolute, Documented},
+		{0x7E, "ROR", 3, AbsoluteX, Documented},
+
+		{0x40, "RTI", 1, None, Documented},
+
+		{0x60, "RTS", 1, None, Documented},
+
+		{0xE9, "SBC", 2, Immediate, Documented},
+		{0xE5, "SBC", 2, ZeroPage, Documented},
+		{0xF5, "SBC", 2, ZeroPageX, Documented},
+		{0xED, "SBC", 3, Absolute, Documented},
+		{0xFD, "SBC", 3, AbsoluteX, Documented},
+		{0xF9, "SBC", 3, AbsoluteY, Documented},
+		{0xE1, "SBC", 2, IndirectX, Documented},
+		{0xF1, "SBC", 2, IndirectY, Documented},
+
+		{0x85, "STA", 2, ZeroPage, Documented},
+		{0x95, "STA", 2, ZeroPageX, Documented},
+		{0x8D, "STA", 3, Absolute, Documented},
+		{0x9D, "STA", 3, AbsoluteX, Documented},
+		{0x99, "STA", 3, AbsoluteY, Documented},
+		{0x81, "STA", 2, IndirectX, Documented},
+		{0x91, "STA", 2, IndirectY, Documented},
+
+		{0x9A, "TXS", 1, None, Documented},
+		{0xBA, "TSX", 1, None, Documented},
+		{0x48, "PHA", 1, None, Documented},
+		{0x68, "PLA", 1, None, Documented},
+		{0x08, "PHP", 1, None, Documented},
+		{0x28, "PLP", 1, None, Documented},
+
+		{0x86, "STX", 2, ZeroPage, Documented},
+		{0x96, "STX", 2, ZeroPageY, Documented},
+		{0x8E, "STX", 3, Absolute, Documented},
+
+		{0x84, "STY", 2, ZeroPage, Documented},
+		{0x94, "STY", 2, ZeroPageX, Documented},
+		{0x8C, "STY", 3, Absolute, Documented},
+	}
+
+	// UndocumentedOpCodes defines the 105 undocumented instructions of the
+	// NMOS 6502, which together with OpCodes covers every byte value.
+	// Mnemonics and behavior from "No More Secrets - NMOS 6510 Unintended
+	// Opcodes" and https://github.com/mattgodbolt/jsbeeb/blob/master/6502.opcodes.js
+	UndocumentedOpCodes = []Opcode{
+		{0x0B, "ANC", 2, Immediate, Stable},
+		{0x2B, "ANC", 2, Immediate, Stable},
+
+		{0x4B, "ALR", 2, Immediate, Stable}, // AND #imm then LSR A
+		{0x6B, "ARR", 2, Immediate, Stable}, // AND #imm then ROR A, odd flags
+
+		{0x8B, "ANE", 2, Immediate, Magic}, // also known as XAA
+		{0xAB, "LXA", 2, Immediate, Magic}, // LAX #imm, also known as OAL
+
+		{0xCB, "SBX", 2, Immediate, Stable},  // X = (A AND X) - imm, also AXS
+		{0xEB, "USBC", 2, Immediate, Stable}, // same as SBC #imm
+
+		{0xC7, "DCP", 2, ZeroPage, Stable},
+		{0xD7, "DCP", 2, ZeroPageX, Stable},
+		{0xCF, "DCP", 3, Absolute, Stable},
+		{0xDF, "DCP", 3, AbsoluteX, Stable},
+		{0xDB, "DCP", 3, AbsoluteY, Stable},
+		{0xC3, "DCP", 2, IndirectX, Stable},
+		{0xD3, "DCP", 2, IndirectY, Stable},
+
+		{0xE7, "ISC", 2, ZeroPage, Stable}, // also known as ISB and INS
+		{0xF7, "ISC", 2, ZeroPageX, Stable},
+		{0xEF, "ISC", 3, Absolute, Stable},
+		{0xFF, "ISC", 3, AbsoluteX, Stable},
+		{0xFB, "ISC", 3, AbsoluteY, Stable},
+		{0xE3, "ISC", 2, IndirectX, Stable},
+		{0xF3, "ISC", 2, IndirectY, Stable},
+
+		{0x02, "KIL", 1, None, Jam}, // also known as JAM and HLT
+		{0x12, "KIL", 1, None, Jam},
+		{0x22, "KIL", 1, None, Jam},
+		{0x32, "KIL", 1, None, Jam},
+		{0x42, "KIL", 1, None, Jam},
+		{0x52, "KIL", 1, None, Jam},
+		{0x62, "KIL", 1, None, Jam},
+		{0x72, "KIL", 1, None, Jam},
+		{0x92, "KIL", 1, None, Jam},
+		{0xB2, "KIL", 1, None, Jam},
+		{0xD2, "KIL", 1, None, Jam},
+		{0xF2, "KIL", 1, None, Jam},
+
+		{0xBB, "LAS", 3, AbsoluteY, Stable}, // also known as LAR
+
+		{0xA7, "LAX", 2, ZeroPage, Stable},
+		{0xB7, "LAX", 2, ZeroPageY, Stable},
+		{0xAF, "LAX", 3, Absolute, Stable},
+		{0xBF, "LAX", 3, AbsoluteY, Stable},
+		{0xA3, "LAX", 2, IndirectX, Stable},
+		{0xB3, "LAX", 2, IndirectY, Stable},
+
+		{0x1A, "NOP", 1, None, Stable},
+		{0x3A, "NOP", 1, None, Stable},
+		{0x5A, "NOP", 1, None, Stable},
+		{0x7A, "NOP", 1, None, Stable},
+		{0xDA, "NOP", 1, None, Stable},
+		{0xFA, "NOP", 1, None, Stable},
+		{0x80, "NOP", 2, Immediate, Stable}, // also known as DOP/SKB
+		{0x82, "NOP", 2, Immediate, Stable},
+		{0x89, "NOP", 2, Immediate, Stable},
+		{0xC2, "NOP", 2, Immediate, Stable},
+		{0xE2, "NOP", 2, Immediate, Stable},
+		{0x04, "NOP", 2, ZeroPage, Stable},
+		{0x44, "NOP", 2, ZeroPage, Stable},
+		{0x64, "NOP", 2, ZeroPage, Stable},
+		{0x14, "NOP", 2, ZeroPageX, Stable},
+		{0x34, "NOP", 2, ZeroPageX, Stable},
+		{0x54, "NOP", 2, ZeroPageX, Stable},
+		{0x74, "NOP", 2, ZeroPageX, Stable},
+		{0xD4, "NOP", 2, ZeroPageX, Stable},
+		{0xF4, "NOP", 2, ZeroPageX, Stable},
+		{0x0C, "NOP", 3, Absolute, Stable}, // also known as TOP/SKW
+		{0x1C, "NOP", 3, AbsoluteX, Stable},
+		{0x3C, "NOP", 3, AbsoluteX, Stable},
+		{0x5C, "NOP", 3, AbsoluteX, Stable},
+		{0x7C, "NOP", 3, AbsoluteX, Stable},
+		{0xDC, "NOP", 3, AbsoluteX, Stable},
+		{0xFC, "NOP", 3, AbsoluteX, Stable},
+
+		{0x27, "RLA", 2, ZeroPage, Stable},
+		{0x37, "RLA", 2, ZeroPageX, Stable},
+		{0x2F, "RLA", 3, Absolute, Stable},
+		{0x3F, "RLA", 3, AbsoluteX, Stable},
+		{0x3B, "RLA", 3, AbsoluteY, Stable},
+		{0x23, "RLA", 2, IndirectX, Stable},
+		{0x33, "RLA", 2, IndirectY, Stable},
+
+		{0x67, "RRA", 2, ZeroPage, Stable},
+		{0x77, "RRA", 2, ZeroPageX, Stable},
+		{0x6F, "RRA", 3, Absolute, Stable},
+		{0x7F, "RRA", 3, AbsoluteX, Stable},
+		{0x7B, "RRA", 3, AbsoluteY, Stable},
+		{0x63, "RRA", 2, IndirectX, Stable},
+		{0x73, "RRA", 2, IndirectY, Stable},
+
+		{0x87, "SAX", 2, ZeroPage, Stable}, // also known as AXS and AAX
+		{0x97, "SAX", 2, ZeroPageY, Stable},
+		{0x8F, "SAX", 3, Absolute, Stable},
+		{0x83, "SAX", 2, IndirectX, Stable},
+
+		{0x9F, "SHA", 3, AbsoluteY, Unstable}, // also known as AHX and AXA
+		{0x93, "SHA", 2, IndirectY, Unstable},
+		{0x9E, "SHX", 3, AbsoluteY, Unstable},
+		{0x9C, "SHY", 3, AbsoluteX, Unstable},
+		{0x9B, "TAS", 3, AbsoluteY, Unstable}, // also known as SHS and XAS
+
+		{0x07, "SLO", 2, ZeroPage, Stable},
+		{0x17, "SLO", 2, ZeroPageX, Stable},
+		{0x0F, "SLO", 3, Absolute, Stable},
+		{0x1F, "SLO", 3, AbsoluteX, Stable},
+		{0x1B, "SLO", 3, AbsoluteY, Stable},
+		{0x03, "SLO", 2, IndirectX, Stable},
+		{0x13, "SLO", 2, IndirectY, Stable},
+
+		{0x47, "SRE", 2, ZeroPage, Stable},
+		{0x57, "SRE", 2, ZeroPageX, Stable},
+		{0x4F, "SRE", 3, Absolute, Stable},
+		{0x5F, "SRE", 3, AbsoluteX, Stable},
+		{0x5B, "SRE", 3, AbsoluteY, Stable},
+		{0x43, "SRE", 2, IndirectX, Stable},
+		{0x53, "SRE", 2, IndirectY, Stable},
 	}
 
 	// OpCodesMap maps from opcode byte value to Opcode. Initialized by init()
 	OpCodesMap map[byte]Opcode
 
-	// UndocumentedInstructions is not exhaustive and only tracks the opcodes
-	// that are included in OpCodesMap.
-	UndocumentedInstructions = []string{"ANC", "SRE", "SLO"}
+	// preferredOpcodes maps an instruction and addressing mode to the opcode
+	// assemblers use for it, the first in OpCodes and UndocumentedOpCodes.
+	// Initialized by init()
+	preferredOpcodes map[instructionMode]byte
+
+	// UndocumentedInstructions lists the mnemonics of the undocumented
+	// instructions in UndocumentedOpCodes. The undocumented NOP variants share
+	// their mnemonic with the documented NOP so are not included, use
+	// Opcode.Undocumented() to tell them apart. How many of them an assembler
+	// supports is given by Dialect.Undocumented().
+	UndocumentedInstructions = []string{
+		"ALR", "ANC", "ANE", "ARR", "DCP", "ISC", "KIL", "LAS", "LAX", "LXA",
+		"RLA", "RRA", "SAX", "SBX", "SHA", "SHX", "SHY", "SLO", "SRE", "TAS",
+		"USBC",
+	}
 
-	branchInstructions = []string{"BPL", "BMI", "BVC", "BVS", "BCC", "BCS", "BNE", "BEQ"}
+	branchInstructions = []string{"BPL", "BMI", "BVC", "BVS", "BCC", "BCS", "BNE", "BEQ", "BRA"}
 
 	jumpInstructions = []string{"JMP", "JSR"}
 
+	// memoryAccess gives how the instructions addressing memory use it, the
+	// branches and jumps are classified by Opcode.Access()
+	memoryAccess = map[string]Access{
+		"ADC": AccessRead, "AND": AccessRead, "BIT": AccessRead, "CMP": AccessRead,
+		"CPX": AccessRead, "CPY": AccessRead, "EOR": AccessRead, "LDA": AccessRead,
+		"LDX": AccessRead, "LDY": AccessRead, "ORA": AccessRead, "SBC": AccessRead,
+		"LAX": AccessRead, "LAS": AccessRead, "NOP": AccessRead,
+
+		"STA": AccessWrite, "STX": AccessWrite, "STY": AccessWrite, "STZ": AccessWrite,
+		"SAX": AccessWrite, "SHA": AccessWrite, "SHX": AccessWrite, "SHY": AccessWrite,
+		"TAS": AccessWrite,
+
+		"ASL": AccessReadModifyWrite, "LSR": AccessReadModifyWrite, "ROL": AccessReadModifyWrite,
+		"ROR": AccessReadModifyWrite, "INC": AccessReadModifyWrite, "DEC": AccessReadModifyWrite,
+		"SLO": AccessReadModifyWrite, "RLA": AccessReadModifyWrite, "SRE": AccessReadModifyWrite,
+		"RRA": AccessReadModifyWrite, "DCP": AccessReadModifyWrite, "ISC": AccessReadModifyWrite,
+		"TSB": AccessReadModifyWrite, "TRB": AccessReadModifyWrite,
+		"RMB": AccessReadModifyWrite, "SMB": AccessReadModifyWrite,
+	}
+
 	// Maps absolute addresses to names of BBC MICRO OS calls
 	addressToOsCallName = map[uint]string{
 		0xFFB9: "OSRDRM",
@@ -329,14 +583,41 @@ const (
 	btJump
 )
 
+// instructionMode is an instruction with an addressing mode
+type instructionMode struct {
+	name string
+	mode AddressingMode
+}
+
 func init() {
 	OpCodesMap = make(map[byte]Opcode)
-	for _, op := range OpCodes {
-		OpCodesMap[op.Value] = op
+	preferredOpcodes = make(map[instructionMode]byte)
+	for _, table := range [][]Opcode{OpCodes, UndocumentedOpCodes} {
+		for _, op := range table {
+			OpCodesMap[op.Value] = op
+			im := instructionMode{op.Name, op.AddrMode}
+			if _, ok := preferredOpcodes[im]; !ok {
+				preferredOpcodes[im] = op.Value
+			}
+		}
 	}
 }
 
+// isPreferredOpcode is true if assemblers use op for its instruction and
+// addressing mode. Other opcodes with the same effect, like the undocumented
+// NOPs, ANC &2B and the KILs after &02, cannot be written as instructions.
+// The instructions added by the 65C02 have a single opcode.
+func isPreferredOpcode(op Opcode) bool {
+	v, ok := preferredOpcodes[instructionMode{op.Name, op.AddrMode}]
+	return !ok || v == op.Value
+}
+
 func (o *Opcode) branchOrJump() branchType {
+	// The Rockwell BBR and BBS instructions branch after testing a bit
+	if o.AddrMode == ZeroPageRelative {
+		return btBranch
+	}
+
 	for _, v := range branchInstructions {
 		if o.Name == v {
 			return btBranch
@@ -352,46 +633,62 @@ func (o *Opcode) branchOrJump() branchType {
 	return btNeither
 }
 
-func genAbsoluteOsCall(bytes []byte, branchTargets map[uint]int) string {
-	addr := (uint(bytes[2]) << 8) + uint(bytes[1])
+// labelFunc returns the name of the label at an address, if there is one
+type labelFunc func(addr uint) (string, bool)
 
+func genAbsoluteOsCall(addr uint, labels labelFunc, dl Dialect) string {
 	// Check if it is a well known OS address
 	if osCall, ok := addressToOsCallName[addr]; ok {
-		return osCall
+		return dl.Symbol(osCall)
 	}
 
 	// Check if it is a known branch target
-	if tgtIdx, ok := branchTargets[addr]; ok {
-		return fmt.Sprintf(labelFormatString, tgtIdx)
+	if name, ok := labels(addr); ok {
+		return name
 	}
 
-	return fmt.Sprintf("&%04X", addr)
+	return dl.Hex(addr, 4)
+}
+
+// operandAddress returns the memory address an instruction operand refers to.
+// Immediate values and relative branch offsets are not addresses.
+func operandAddress(op Opcode, bytes []byte) (uint, bool) {
+	switch op.AddrMode {
+	case ZeroPage, ZeroPageX, ZeroPageY, IndirectX, IndirectY, ZeroPageIndirect, ZeroPageRelative:
+		return uint(bytes[1]), true
+	case Absolute, AbsoluteX, AbsoluteY, Indirect, AbsoluteIndirectX:
+		return (uint(bytes[2]) << 8) + uint(bytes[1]), true
+	}
+	return 0, false
 }
 
-func genBranch(bytes []byte, cursor, branchAdjust uint, branchTargets map[uint]int) string {
+// branchOffset returns the offset from the branch opcode to the branch target.
+// The relative offset is always the last byte of the instruction.
+func branchOffset(bytes []byte) int {
+	boff := int(bytes[len(bytes)-1])
+	if boff > 127 {
+		boff = boff - 256
+	}
 	// From http://www.6502.org/tutorials/6502opcodes.html
 	// "When calculating branches a forward branch of 6 skips the following 6
 	// bytes so, effectively the program counter points to the address that is 8
 	// bytes beyond the address of the branch opcode; and a backward branch of
 	// $FA (256-6) goes to an address 4 bytes before the branch instruction."
-	boff := int(bytes[1]) // All branches are 2 bytes long
-	if boff > 127 {
-		boff = boff - 256
-	}
-	// Adjust offset to account for the 2 byte behavior from the comment block
-	// above.
-	boff += 2
+	// Adjust offset to account for the instruction length.
+	return boff + len(bytes)
+}
 
-	tgt := cursor + uint(boff) + branchAdjust
+func genBranch(in Instruction, labels labelFunc, dl Dialect) string {
+	boff := branchOffset(in.Bytes)
 	// TODO: Explore branch relative offset in the end of line comment
 
-	tgtIdx, ok := branchTargets[tgt]
+	name, ok := labels(in.Target)
 	if !ok {
 		// If the branch offset is not a 'reachable' instruction then express
-		// the branch with the relative offset. However beebasm interprets an
-		// integer literal as an absolute address, so instead write out an
-		// expression that generates the same opcodes, e.g. P%+12 or P%-87
-		return fmt.Sprintf("P%%%+d", boff)
+		// the branch with the relative offset. However assemblers interpret
+		// an integer literal as an absolute address, so instead write out an
+		// expression that generates the same opcodes, e.g. P%+12 or *-87
+		return fmt.Sprintf("%s%+d", dl.PC(), boff)
 	}
-	return fmt.Sprintf(labelFormatString, tgtIdx)
+	return name
 }
@@ -0,0 +1,263 @@
+package bbcdisasm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+)
+
+var labelNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Address is a 16-bit address in a project file. It can be written as a JSON
+// number or as a string in any of the forms accepted by ParseAddress, e.g.
+// "&3A12".
+type Address uint
+
+// UnmarshalJSON decodes an address from a number or a string
+func (a *Address) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n uint
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("invalid address %s", data)
+		}
+		*a = Address(n)
+		return nil
+	}
+	return a.UnmarshalText([]byte(s))
+}
+
+// UnmarshalText decodes an address from a string, used for JSON object keys
+func (a *Address) UnmarshalText(text []byte) error {
+	val, err := ParseAddress(string(text))
+	if err != nil {
+		return err
+	}
+	*a = Address(val)
+	return nil
+}
+
+// ProjectRegion marks the addresses Start up to End as Type, one of the names
+// accepted by ParseRegionType. The split table types pointers-lo and
+// pointers-hi also mark the other table, starting at Partner.
+type ProjectRegion struct {
+	Start   Address  `json:"start"`
+	End     Address  `json:"end"`
+	Type    string   `json:"type"`
+	Partner *Address `json:"partner,omitempty"`
+}
+
+// Project holds the accumulated knowledge of a reverse engineering session,
+// replacing a long disasm command line. It is stored as JSON, for example
+//
+//  {
+//    "disk": "Exile.ssd",
+//    "entry": "EXILE",
+//    "load_addr": "&3000",
+//    "entry_points": ["&4A10"],
+//    "labels": {"apples": "&0DBC"},
+//    "comments": {"&4A10": "Entry point"},
+//    "block_comments": {"&4A10": "Initialise the screen\nand keyboard"},
+//    "regions": [{"start": "&3000", "end": "&3100", "type": "bytes"}],
+//    "operands": {"&4A3A": "apples"}
+//  }
+type Project struct {
+	// The program is either the file Source or the file Entry from the DFS
+	// disk image Disk. Paths are relative to the project file.
+	Source string `json:"source,omitempty"`
+	Disk   string `json:"disk,omitempty"`
+	Entry  string `json:"entry,omitempty"`
+
+	// Load address of the program. Defaults to the catalog load address of a
+	// disk entry.
+	LoadAddr *Address `json:"load_addr,omitempty"`
+
+	// The range of the program to disassemble, as offsets from its start. A
+	// zero length disassembles to the end of the program.
+	Offset Address `json:"offset,omitempty"`
+	Length Address `json:"length,omitempty"`
+
+	CPU         string             `json:"cpu,omitempty"`          // see ParseCPU
+	EntryPoints []Address          `json:"entry_points,omitempty"` // known code addresses
+	Labels      map[string]Address `json:"labels,omitempty"`       // name to address
+	Symbols     []string           `json:"symbols,omitempty"`      // symbol files, see ParseSymbols
+
+	Comments      map[Address]string `json:"comments,omitempty"`       // inline comments by address
+	BlockComments map[Address]string `json:"block_comments,omitempty"` // comments above an address
+	Regions       []ProjectRegion    `json:"regions,omitempty"`
+	Operands      map[Address]string `json:"operands,omitempty"` // operand text by instruction address
+
+	// Subroutines followed by inline data, see ParseInlineData
+	Inline       map[Address]string `json:"inline,omitempty"`
+	DetectInline bool               `json:"detect_inline,omitempty"`
+
+	// Targets of indirect jumps by the address of the jump
+	Indirect        map[Address][]Address `json:"indirect,omitempty"`
+	ResolveIndirect bool                  `json:"resolve_indirect,omitempty"`
+
+	// Detection of strings, with the minimum length and the characters, see
+	// ParseCharset, address tables and subroutines
+	Strings     bool   `json:"strings,omitempty"`
+	StringMin   int    `json:"string_min,omitempty"`
+	StringChars string `json:"string_chars,omitempty"`
+	Tables      bool   `json:"tables,omitempty"`
+	Subroutines bool   `json:"subroutines,omitempty"`
+
+	Dialect string `json:"dialect,omitempty"` // see ParseDialect
+	XRefs   string `json:"xrefs,omitempty"`   // see ParseXRefStyle
+}
+
+// LoadProject reads a project from JSON
+func LoadProject(r io.Reader) (*Project, error) {
+	var p Project
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+	if p.Source == "" && (p.Disk == "" || p.Entry == "") {
+		return nil, fmt.Errorf("project needs a source file or a disk and entry")
+	}
+	if err := p.checkLabels(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// checkLabels returns an error if the name of a label is not an identifier
+func (p *Project) checkLabels() error {
+	for name := range p.Labels {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+	}
+	return nil
+}
+
+// NewDisassemblerFromProject initializes a new Disassembler for program
+// configured by the project. Symbol files named by the project are not read,
+// the caller should load them with ParseSymbols and AddSymbols.
+func NewDisassemblerFromProject(p *Project, program []byte) (*Disassembler, error) {
+	d := NewDisassembler(program)
+
+	if uint(p.Offset) >= uint(len(program)) {
+		return nil, fmt.Errorf("offset &%X is past the end of the program", uint(p.Offset))
+	}
+	d.Offset = uint(p.Offset)
+	d.MaxBytes = uint(len(program)) - d.Offset
+	if p.Length != 0 && uint(p.Length) < d.MaxBytes {
+		d.MaxBytes = uint(p.Length)
+	}
+	if p.LoadAddr != nil {
+		d.BranchAdjust = uint(*p.LoadAddr)
+	}
+
+	if p.CPU != "" {
+		cpu, err := ParseCPU(p.CPU)
+		if err != nil {
+			return nil, err
+		}
+		d.CPU = cpu
+	}
+
+	if p.Dialect != "" {
+		dl, err := ParseDialect(p.Dialect)
+		if err != nil {
+			return nil, err
+		}
+		d.Dialect = dl
+	}
+	if p.XRefs != "" {
+		style, err := ParseXRefStyle(p.XRefs)
+		if err != nil {
+			return nil, err
+		}
+		d.CrossReferences = style
+	}
+
+	for _, addr := range p.EntryPoints {
+		d.CodeAddrs = append(d.CodeAddrs, uint(addr))
+	}
+
+	if err := p.checkLabels(); err != nil {
+		return nil, err
+	}
+
+	// Sort by name so the name used for an address with several is stable
+	names := make([]string, 0, len(p.Labels))
+	for name := range p.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var syms []Symbol
+	for _, name := range names {
+		syms = appendSymbol(syms, name, uint(p.Labels[name]))
+	}
+	d.AddSymbols(syms)
+
+	for _, r := range p.Regions {
+		t, err := ParseRegionType(r.Type)
+		if err != nil {
+			return nil, err
+		}
+		if r.End <= r.Start {
+			return nil, fmt.Errorf("%s region &%04X-&%04X is empty", t, uint(r.Start), uint(r.End))
+		}
+		switch t {
+		case RegionPointersLo, RegionPointersHi:
+			if r.Partner == nil {
+				return nil, fmt.Errorf("%s region at &%04X has no partner", t, uint(r.Start))
+			}
+			lo, hi := uint(r.Start), uint(*r.Partner)
+			if t == RegionPointersHi {
+				lo, hi = hi, lo
+			}
+			d.Regions.MarkSplit(lo, hi, uint(r.End-r.Start))
+		default:
+			d.Regions.Mark(uint(r.Start), uint(r.End), t)
+		}
+	}
+
+	for addr, text := range p.Comments {
+		d.Comments[uint(addr)] = text
+	}
+	for addr, text := range p.BlockComments {
+		d.BlockComments[uint(addr)] = text
+	}
+	for addr, text := range p.Operands {
+		d.Operands[uint(addr)] = text
+	}
+
+	for addr, spec := range p.Inline {
+		id, err := ParseInlineData(spec)
+		if err != nil {
+			return nil, err
+		}
+		d.Inline[uint(addr)] = id
+	}
+	d.DetectInline = p.DetectInline
+
+	for addr, targets := range p.Indirect {
+		for _, target := range targets {
+			d.IndirectTargets[uint(addr)] = append(d.IndirectTargets[uint(addr)], uint(target))
+		}
+	}
+	d.ResolveIndirect = p.ResolveIndirect
+
+	if p.Strings {
+		d.Strings = &StringDetector{MinLength: p.StringMin}
+		if p.StringChars != "" {
+			charset, err := ParseCharset(p.StringChars)
+			if err != nil {
+				return nil, err
+			}
+			d.Strings.Charset = charset
+		}
+	}
+	d.Tables = p.Tables
+	d.Subroutines = p.Subroutines
+
+	return d, nil
+}
@@ -0,0 +1,57 @@
+package bbcdisasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestProjectRejectsEmptyRegions(t *testing.T) {
+	for _, region := range []string{
+		`{"start": "&1910", "end": "&1910", "type": "bytes"}`,
+		`{"start": "&1910", "end": "&1908", "type": "words"}`,
+		`{"start": "&1910", "end": "&1908", "type": "pointers-lo", "partner": "&1920"}`,
+	} {
+		p, err := LoadProject(strings.NewReader(`{"source": "prog", "load_addr": "&1900", "regions": [` + region + `]}`))
+		if err != nil {
+			t.Fatalf("LoadProject: %v", err)
+		}
+		if _, err := NewDisassemblerFromProject(p, make([]byte, 0x40)); err == nil {
+			t.Errorf("region %s is accepted", region)
+		}
+	}
+}
+
+func TestProjectRejectsInvalidLabels(t *testing.T) {
+	for _, name := range []string{"", "1st", "two words"} {
+		labels := map[string]Address{name: 0x1900}
+		if _, err := NewDisassemblerFromProject(&Project{Source: "prog", Labels: labels}, make([]byte, 0x40)); err == nil {
+			t.Errorf("label %q is accepted", name)
+		}
+		src := `{"source": "prog", "labels": {"` + name + `": "&1900"}}`
+		if _, err := LoadProject(strings.NewReader(src)); err == nil {
+			t.Errorf("LoadProject accepts label %q", name)
+		}
+	}
+}
+
+func TestProjectDetectors(t *testing.T) {
+	src := `{"source": "prog", "strings": true, "string_min": 4, "string_chars": "text",
+		"tables": true, "subroutines": true, "dialect": "ca65", "xrefs": "table"}`
+	p, err := LoadProject(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("LoadProject: %v", err)
+	}
+	d, err := NewDisassemblerFromProject(p, make([]byte, 0x40))
+	if err != nil {
+		t.Fatalf("NewDisassemblerFromProject: %v", err)
+	}
+	if d.Strings == nil || d.Strings.MinLength != 4 || d.Strings.Charset == nil || d.Strings.Charset.Contains('~') {
+		t.Errorf("strings are %+v, want text of at least 4 characters", d.Strings)
+	}
+	if !d.Tables || !d.Subroutines {
+		t.Errorf("tables %v and subroutines %v, want both", d.Tables, d.Subroutines)
+	}
+	if d.Dialect != CA65 || d.CrossReferences != XRefTable {
+		t.Errorf("dialect %s and xrefs %v, want ca65 and table", d.dialect().Name(), d.CrossReferences)
+	}
+}
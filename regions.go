@@ -0,0 +1,178 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RegionType describes how the bytes in an address range should be treated
+type RegionType int
+
+// Region Types
+//  RegionUnknown  - no knowledge, the disassembler decides
+//  RegionCode     - instructions
+//  RegionBytes    - data bytes                        - EQUB &01,&02
+//  RegionWords    - 16-bit little endian data words   - EQUW &0201
+//  RegionString   - text                              - EQUS "HELLO"
+//  RegionPointers - 16-bit addresses                  - EQUW label_3
+//  RegionPointersLo, RegionPointersHi
+//                 - 16-bit addresses split into tables of low and high
+//                   bytes, the other table is at the region's Partner
+//                                                     - EQUB LO(label_3)
+const (
+	RegionUnknown RegionType = iota
+	RegionCode
+	RegionBytes
+	RegionWords
+	RegionString
+	RegionPointers
+	RegionPointersLo
+	RegionPointersHi
+)
+
+var regionTypeNames = map[RegionType]string{
+	RegionUnknown:    "unknown",
+	RegionCode:       "code",
+	RegionBytes:      "bytes",
+	RegionWords:      "words",
+	RegionString:     "string",
+	RegionPointers:   "pointers",
+	RegionPointersLo: "pointers-lo",
+	RegionPointersHi: "pointers-hi",
+}
+
+func (t RegionType) String() string {
+	if s, ok := regionTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("RegionType(%d)", int(t))
+}
+
+// MarshalText encodes the type as its name
+func (t RegionType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// ParseRegionType converts a region type name, as returned by
+// RegionType.String(), into a RegionType.
+func ParseRegionType(s string) (RegionType, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for t, name := range regionTypeNames {
+		if name == s {
+			return t, nil
+		}
+	}
+	return RegionUnknown, fmt.Errorf("unknown region type %q", s)
+}
+
+// isData is true for region types that hold data rather than instructions
+func (t RegionType) isData() bool {
+	return t != RegionUnknown && t != RegionCode
+}
+
+// Region is a range of addresses [Start, End) of a single type
+type Region struct {
+	Start uint
+	End   uint
+	Type  RegionType
+
+	// The start of the matching table of a RegionPointersLo or
+	// RegionPointersHi region
+	Partner uint
+}
+
+// RegionMap records the type of address ranges of a program. Addresses not
+// covered by any region are RegionUnknown. The zero value is an empty map.
+type RegionMap struct {
+	regions []Region // sorted by Start, non-overlapping
+}
+
+// Mark sets the type of the address range [start, end), replacing the type of
+// any previously marked addresses in the range. Marking a range as
+// RegionUnknown removes it from the map.
+func (m *RegionMap) Mark(start, end uint, t RegionType) {
+	m.mark(Region{Start: start, End: end, Type: t})
+}
+
+// MarkSplit marks a table of n 16-bit addresses split into a table of low
+// bytes at lo and a table of high bytes at hi.
+func (m *RegionMap) MarkSplit(lo, hi, n uint) {
+	m.mark(Region{lo, lo + n, RegionPointersLo, hi})
+	m.mark(Region{hi, hi + n, RegionPointersHi, lo})
+}
+
+func (m *RegionMap) mark(nr Region) {
+	if nr.End <= nr.Start {
+		return
+	}
+
+	var out []Region
+	for _, r := range m.regions {
+		if r.End <= nr.Start || r.Start >= nr.End {
+			out = append(out, r)
+			continue
+		}
+		// Keep the parts of the existing region that lie outside the new range
+		if r.Start < nr.Start {
+			out = append(out, Region{r.Start, nr.Start, r.Type, r.Partner})
+		}
+		if r.End > nr.End {
+			out = append(out, Region{nr.End, r.End, r.Type, r.partnerAt(nr.End)})
+		}
+	}
+	if nr.Type != RegionUnknown {
+		out = append(out, nr)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start < out[j].Start })
+
+	// Merge adjacent regions of the same type
+	m.regions = out[:0]
+	for _, r := range out {
+		if n := len(m.regions); n > 0 {
+			prev := &m.regions[n-1]
+			if prev.End == r.Start && prev.Type == r.Type && prev.partnerAt(r.Start) == r.Partner {
+				prev.End = r.End
+				continue
+			}
+		}
+		m.regions = append(m.regions, r)
+	}
+}
+
+// partnerAt returns the address in the partner table matching addr
+func (r Region) partnerAt(addr uint) uint {
+	if r.Type != RegionPointersLo && r.Type != RegionPointersHi {
+		return 0
+	}
+	return r.Partner + addr - r.Start
+}
+
+// Lookup returns the region containing addr. If addr has not been marked then
+// the returned region is RegionUnknown and spans the gap between the
+// surrounding marked regions.
+func (m *RegionMap) Lookup(addr uint) Region {
+	i := sort.Search(len(m.regions), func(i int) bool { return m.regions[i].End > addr })
+	if i < len(m.regions) && m.regions[i].Start <= addr {
+		return m.regions[i]
+	}
+
+	r := Region{0, ^uint(0), RegionUnknown, 0}
+	if i > 0 {
+		r.Start = m.regions[i-1].End
+	}
+	if i < len(m.regions) {
+		r.End = m.regions[i].Start
+	}
+	return r
+}
+
+// Regions returns the marked regions in order of increasing address
+func (m *RegionMap) Regions() []Region {
+	return append([]Region(nil), m.regions...)
+}
+
+// Len returns the number of marked regions
+func (m *RegionMap) Len() int {
+	return len(m.regions)
+}
@@ -0,0 +1,217 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const subroutineFormatString = "sub_%04X"
+
+// subroutine is a subroutine found by findSubroutines
+type subroutine struct {
+	entry  uint
+	end    uint // address after the last instruction
+	name   string
+	scoped bool // the local labels are in a scope of the dialect
+}
+
+// findSubroutines finds the extent of each subroutine, the targets of JSR in
+// the program, and names them and the labels local to them. A subroutine
+// runs from its entry to the first RTS, RTI or JMP that no branch in the
+// subroutine jumps beyond, stopping early at the next subroutine or at bytes
+// that are not an instruction. Labels are local if they are only the
+// targets of branches and jumps from inside the subroutine.
+func (d *Disassembler) findSubroutines() {
+	d.subroutines = make(map[uint]*subroutine)
+	d.subroutineLabels = make(map[uint]string)
+	d.qualifiedLabels = make(map[uint]string)
+	if !d.Subroutines {
+		return
+	}
+
+	var ins []Instruction
+	d.walk(vtCode, func(_, _ uint, in Instruction, err error) int {
+		if err != nil {
+			return 1
+		}
+		ins = append(ins, in)
+		return int(in.Length())
+	}, nil)
+	index := make(map[uint]int)
+	for i, in := range ins {
+		index[in.Address] = i
+	}
+
+	var entries []uint
+	for addr, xrefs := range d.xrefs {
+		if _, ok := d.branchTargets[addr]; !ok {
+			continue
+		}
+		if _, ok := index[addr]; !ok {
+			continue
+		}
+		for _, x := range xrefs {
+			if x.Access == AccessCall {
+				entries = append(entries, addr)
+				break
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i] < entries[j] })
+
+	// Anchors of references as data, e.g. by self modifying code, are not
+	// local as the operands are written as offsets from the label
+	anchors := make(map[uint]bool)
+	for _, anchor := range d.dataRefs {
+		anchors[anchor] = true
+	}
+
+	_, _, prefix := d.dialect().Scope()
+	for n, entry := range entries {
+		next := ^uint(0)
+		if n+1 < len(entries) {
+			next = entries[n+1]
+		}
+		sub := &subroutine{entry: entry, end: d.subroutineEnd(ins, index[entry], next)}
+		sub.name = fmt.Sprintf(subroutineFormatString, entry)
+		if name, ok := d.namedLabels[entry]; ok {
+			sub.name = name
+		} else {
+			d.subroutineLabels[entry] = sub.name
+		}
+		d.subroutines[entry] = sub
+
+		// Name the local labels, loops for the targets of backward branches
+		var labels []uint
+		for addr := range d.branchTargets {
+			if addr > entry && addr < sub.end {
+				labels = append(labels, addr)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i] < labels[j] })
+		local := make(map[uint]string)
+		loops, skips := 0, 0
+		global := d.hasGlobalLabel(entry, sub.end)
+		for _, addr := range labels {
+			if _, ok := d.namedLabels[addr]; ok || anchors[addr] || d.entryPoints[addr] || len(d.xrefs[addr]) == 0 {
+				global = true
+				continue
+			}
+			backward := false
+			inside := true
+			for _, x := range d.xrefs[addr] {
+				inside = inside && x.From >= entry && x.From < sub.end
+				backward = backward || x.From >= addr
+			}
+			if !inside {
+				global = true
+				continue
+			}
+			if backward {
+				loops++
+				local[addr] = fmt.Sprintf("loop_%d", loops)
+			} else {
+				skips++
+				local[addr] = fmt.Sprintf("skip_%d", skips)
+			}
+		}
+
+		// Dialects without a prefix for local labels make every label in a
+		// scope local, so only subroutines without global labels are scoped.
+		// The local labels of the others have the subroutine name to keep
+		// them unique, as do those of scoped subroutines in the symbol table.
+		open, _, _ := d.dialect().Scope()
+		sub.scoped = open != "" && (prefix != "" || !global)
+		for addr, name := range local {
+			if sub.scoped {
+				d.subroutineLabels[addr] = prefix + name
+				d.qualifiedLabels[addr] = sub.name + "_" + name
+			} else {
+				d.subroutineLabels[addr] = sub.name + "_" + name
+			}
+		}
+	}
+}
+
+// subroutineEnd returns the address after the last instruction of the
+// subroutine whose entry is ins[i]
+func (d *Disassembler) subroutineEnd(ins []Instruction, i int, next uint) uint {
+	var reach uint // the furthest forward branch target
+	for ; i < len(ins); i++ {
+		in := ins[i]
+		if (in.Branch || in.Jump) && in.HasTarget && in.Target > in.Address && in.Target < next {
+			if in.Target > reach {
+				reach = in.Target
+			}
+		}
+		switch {
+		case in.Next() >= next:
+			return next
+		case (in.Return || in.Jump) && reach < in.Next():
+			return in.Next()
+		case i+1 == len(ins) || ins[i+1].Address != in.Next():
+			// The following bytes are not an instruction
+			return in.Next()
+		}
+	}
+	return next
+}
+
+// hasGlobalLabel is true if there is a label between start and end that
+// does not belong to a branch target, e.g. a label on data
+func (d *Disassembler) hasGlobalLabel(start, end uint) bool {
+	for addr := range d.dataLabels {
+		if addr > start && addr < end {
+			return true
+		}
+	}
+	for addr := range d.namedLabels {
+		if addr > start && addr < end {
+			return true
+		}
+	}
+	return false
+}
+
+// subroutineHeader returns the lines before the entry of a subroutine: a
+// separator, its name, the callers and the subroutines it calls
+func (d *Disassembler) subroutineHeader(sub *subroutine) []Line {
+	dl := d.dialect()
+	var callers, calls []string
+	for _, x := range d.xrefs[sub.entry] {
+		if x.Access == AccessCall {
+			callers = append(callers, dl.Hex(x.From, 4))
+		}
+	}
+	sort.Strings(callers)
+	seen := make(map[string]bool)
+	for _, x := range d.XRefs() {
+		if x.Access != AccessCall || x.From < sub.entry || x.From >= sub.end {
+			continue
+		}
+		name := dl.Hex(x.Addr, 4)
+		if osCall, ok := addressToOsCallName[x.Addr]; ok {
+			name = dl.Symbol(osCall)
+		} else if label, ok := d.addrName(x.Addr); ok {
+			name = label
+		}
+		if !seen[name] {
+			seen[name] = true
+			calls = append(calls, name)
+		}
+	}
+
+	separator := strings.Repeat("-", 78)
+	lines := []Line{
+		{Kind: LineBlank, Address: sub.entry},
+		{Kind: LineComment, Address: sub.entry, Text: separator},
+		{Kind: LineComment, Address: sub.entry, Text: fmt.Sprintf("%s  %s-%s", sub.name, dl.Hex(sub.entry, 4), dl.Hex(sub.end-1, 4))},
+		{Kind: LineComment, Address: sub.entry},
+		{Kind: LineComment, Address: sub.entry, Text: "Called from " + strings.Join(callers, " ")},
+	}
+	if len(calls) > 0 {
+		lines = append(lines, Line{Kind: LineComment, Address: sub.entry, Text: "Calls " + strings.Join(calls, " ")})
+	}
+	return append(lines, Line{Kind: LineComment, Address: sub.entry, Text: separator})
+}
@@ -0,0 +1,89 @@
+package bbcdisasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSubroutineEndsAfterForwardBranchTarget(t *testing.T) {
+	program := []byte{
+		0x20, 0x04, 0x19, // JSR sub
+		0x60,       // RTS
+		0xA2, 0x03, // .sub LDX #&03
+		0xCA,       // .loop DEX
+		0xF0, 0x03, // BEQ done
+		0x4C, 0x06, 0x19, // JMP loop
+		0x60, // .done RTS
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.Subroutines = true
+	if err := d.Lines(func(Line) bool { return true }); err != nil {
+		t.Fatalf("Lines: %v", err)
+	}
+
+	sub := d.subroutines[0x1904]
+	if sub == nil {
+		t.Fatal("no subroutine at &1904")
+	}
+	if sub.end != 0x190D {
+		t.Errorf("subroutine ends at &%04X, want &190D", sub.end)
+	}
+	if name := d.subroutineLabels[0x190C]; name != "skip_1" {
+		t.Errorf("label of the RTS is %q, want skip_1 local to the subroutine", name)
+	}
+}
+
+func TestSubroutineLocalLabelsInSymbols(t *testing.T) {
+	program := []byte{
+		0x20, 0x07, 0x19, // JSR sub_1907
+		0x20, 0x0D, 0x19, // JSR sub_190D
+		0x60,       // RTS
+		0xA2, 0x03, // .sub_1907 LDX #&03
+		0xCA,       // .loop_1 DEX
+		0xD0, 0xFD, // BNE loop_1
+		0x60,       // RTS
+		0xA0, 0x03, // .sub_190D LDY #&03
+		0x88,       // .loop_1 DEY
+		0xD0, 0xFD, // BNE loop_1
+		0x60, // RTS
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.Subroutines = true
+	var html strings.Builder
+	if err := d.WriteHTML(&html, "test"); err != nil {
+		t.Fatalf("WriteHTML: %v", err)
+	}
+
+	names := make(map[uint]string)
+	for _, sym := range d.Symbols() {
+		names[sym.Addr] = sym.Name
+	}
+	if names[0x1909] != "sub_1907_loop_1" || names[0x190F] != "sub_190D_loop_1" {
+		t.Errorf("loops are named %q and %q, want sub_1907_loop_1 and sub_190D_loop_1", names[0x1909], names[0x190F])
+	}
+
+	// The exported symbols assemble
+	var syms strings.Builder
+	if err := WriteBeebasmSymbols(&syms, d.Symbols()); err != nil {
+		t.Fatalf("WriteBeebasmSymbols: %v", err)
+	}
+	if _, err := Assemble(strings.NewReader(syms.String())); err != nil {
+		t.Errorf("Assemble symbols: %v\n%s", err, syms.String())
+	}
+
+	// Each BNE links to the loop of its own subroutine
+	for _, want := range []string{
+		`id="sym-1909"`,
+		`id="sym-190F"`,
+		`BNE <a href="#sym-1909"`,
+		`BNE <a href="#sym-190F"`,
+	} {
+		if !strings.Contains(html.String(), want) {
+			t.Errorf("HTML does not contain %s", want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package bbcdisasm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SymbolKind describes what a symbol names
+type SymbolKind int
+
+// Symbol Kinds
+//  SymbolVar      - a user defined variable or imported symbol
+//  SymbolLabel    - a branch, jump or call target in the program
+//  SymbolData     - data in the program referenced by an operand
+//  SymbolOSCall   - an OS entry point, e.g. OSWRCH
+//  SymbolOSVector - an OS vector, e.g. WRCHV
+const (
+	SymbolVar SymbolKind = iota
+	SymbolLabel
+	SymbolData
+	SymbolOSCall
+	SymbolOSVector
+)
+
+var symbolKindNames = []string{"var", "label", "data", "oscall", "osvector"}
+
+func (k SymbolKind) String() string {
+	if int(k) < len(symbolKindNames) {
+		return symbolKindNames[k]
+	}
+	return fmt.Sprintf("SymbolKind(%d)", int(k))
+}
+
+// MarshalText encodes the kind as its name
+func (k SymbolKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Symbol is a name for an address
+type Symbol struct {
+	Name string
+	Addr uint
+	Kind SymbolKind
+	Refs int // Number of operands referring to the symbol
+}
+
+var (
+	// beebasm -d dumps all symbols on one line, [{'name':12345L,...}]
+	beebasmSymbolRe = regexp.MustCompile(`'([^']+)'\s*:\s*(\d+)L?`)
+
+	// VICE label files and ld65 -Ln output, al C:1234 .name
+	viceSymbolRe = regexp.MustCompile(`^al\s+(?:[A-Za-z]:)?([0-9A-Fa-f]+)\s+\.?(\S+)`)
+
+	// ca65/ld65 debug files hold one record per line, type key=value,...
+	dbgRecordRe = regexp.MustCompile(`^[a-z]+\s+[a-z]+=`)
+	dbgFieldRe  = regexp.MustCompile(`([a-z]+)=("[^"]*"|[^,]*)`)
+
+	// Simple assignments, name = &1234
+	assignSymbolRe = regexp.MustCompile(`^([A-Za-z_.@][\w.@:]*)\s*=\s*([&$%]?\w+)`)
+
+	invalidSymbolCharRe = regexp.MustCompile(`[^A-Za-z0-9_]`)
+)
+
+// ParseSymbols reads symbol definitions from r. The format of each line is
+// detected independently, so files may mix formats. Supported formats are
+//  beebasm -d symbol dumps      - [{'name':12345L,...}]
+//  VICE and ld65 -Ln label files - al C:1234 .name
+//  ca65/ld65 .dbg debug files    - sym id=0,name="name",...,val=0x1234,...
+//  assignments                   - name = &1234
+// Blank lines and lines starting with a comment character are ignored. Names
+// are converted to valid beebasm symbol names.
+func ParseSymbols(r io.Reader) ([]Symbol, error) {
+	var syms []Symbol
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024) // beebasm dumps are a single long line
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.IndexAny(line[:1], `\;#`) == 0 || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "[{"):
+			for _, m := range beebasmSymbolRe.FindAllStringSubmatch(line, -1) {
+				val, err := strconv.ParseUint(m[2], 10, 32)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+				syms = appendSymbol(syms, m[1], uint(val))
+			}
+		case viceSymbolRe.MatchString(line):
+			m := viceSymbolRe.FindStringSubmatch(line)
+			val, err := strconv.ParseUint(m[1], 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			syms = appendSymbol(syms, m[2], uint(val))
+		case dbgRecordRe.MatchString(line):
+			// Only symbol records with a value are of interest, imports have
+			// no value.
+			if !strings.HasPrefix(line, "sym") {
+				continue
+			}
+			fields := make(map[string]string)
+			for _, m := range dbgFieldRe.FindAllStringSubmatch(line, -1) {
+				fields[m[1]] = strings.Trim(m[2], `"`)
+			}
+			if fields["name"] == "" || fields["val"] == "" {
+				continue
+			}
+			val, err := ParseAddress(fields["val"])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			syms = appendSymbol(syms, fields["name"], val)
+		case assignSymbolRe.MatchString(line):
+			m := assignSymbolRe.FindStringSubmatch(line)
+			val, err := ParseAddress(m[2])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			syms = appendSymbol(syms, m[1], val)
+		default:
+			return nil, fmt.Errorf("line %d: unrecognized symbol definition %q", lineNum, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return syms, nil
+}
+
+func appendSymbol(syms []Symbol, name string, addr uint) []Symbol {
+	name = invalidSymbolCharRe.ReplaceAllString(name, "_")
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return append(syms, Symbol{Name: name, Addr: addr})
+}
+
+// ParseAddress parses a number written in any of the common 6502 assembler
+// forms: &1234 and $1234 for hexadecimal, %1010 for binary, 0x1234 or decimal.
+func ParseAddress(s string) (uint, error) {
+	s = strings.TrimSpace(s)
+	var val uint64
+	var err error
+	switch {
+	case strings.HasPrefix(s, "&") || strings.HasPrefix(s, "$"):
+		val, err = strconv.ParseUint(s[1:], 16, 32)
+	case strings.HasPrefix(s, "%"):
+		val, err = strconv.ParseUint(s[1:], 2, 32)
+	default:
+		val, err = strconv.ParseUint(s, 0, 32)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q", s)
+	}
+	return uint(val), nil
+}
+
+// WriteVICESymbols writes symbols as a VICE label file, which can also be read
+// by the b2 and BeebJit debuggers.
+func WriteVICESymbols(w io.Writer, syms []Symbol) error {
+	for _, sym := range syms {
+		if _, err := fmt.Fprintf(w, "al C:%04X .%s\n", sym.Addr, sym.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBeebasmSymbols writes symbols as beebasm assignments suitable for
+// INCLUDE into another source file.
+func WriteBeebasmSymbols(w io.Writer, syms []Symbol) error {
+	if _, err := fmt.Fprintln(w, "\\ Symbols exported by bbcdisasm"); err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if _, err := fmt.Fprintf(w, "%-12s = &%04X \\ %s\n", sym.Name, sym.Addr, sym.Kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonSymbol is a symbol in the JSON formats
+type jsonSymbol struct {
+	Address uint       `json:"address"`
+	Name    string     `json:"name"`
+	Kind    SymbolKind `json:"kind"`
+	Refs    int        `json:"refs"`
+}
+
+// jsonSymbols returns symbols for the JSON formats
+func jsonSymbols(syms []Symbol) []jsonSymbol {
+	out := make([]jsonSymbol, len(syms))
+	for i, sym := range syms {
+		out[i] = jsonSymbol{sym.Addr, sym.Name, sym.Kind, sym.Refs}
+	}
+	return out
+}
+
+// WriteJSONSymbols writes symbols as a JSON array of objects with address,
+// name, kind and refs fields.
+func WriteJSONSymbols(w io.Writer, syms []Symbol) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(jsonSymbols(syms))
+}
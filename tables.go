@@ -0,0 +1,297 @@
+package bbcdisasm
+
+// Limits on the search for address tables
+const (
+	tableWindow     = 8   // instructions from the first load to the second
+	maxTableEntries = 256 // an 8-bit index reaches at most 256 entries
+)
+
+// register returns the register an instruction loads from or stores to
+// memory, if it is one of LDA, LDX, LDY, STA, STX or STY.
+func (in Instruction) register(names ...string) (byte, bool) {
+	for _, n := range names {
+		if in.Opcode.Name == n {
+			return n[2], true
+		}
+	}
+	return 0, false
+}
+
+// indexedLoad matches an indexed absolute load, e.g. LDA table,X, returning
+// the register loaded, the index register and the table address.
+func (in Instruction) indexedLoad() (reg, index byte, addr uint, ok bool) {
+	if reg, ok = in.register("LDA", "LDX", "LDY"); !ok {
+		return
+	}
+	switch in.Mode {
+	case AbsoluteX:
+		index = 'X'
+	case AbsoluteY:
+		index = 'Y'
+	default:
+		return 0, 0, 0, false
+	}
+	return reg, index, in.Operand, true
+}
+
+// store matches a store of reg to a zero page or absolute address
+func (in Instruction) store(reg byte) (uint, bool) {
+	if r, ok := in.register("STA", "STX", "STY"); !ok || r != reg {
+		return 0, false
+	}
+	if in.Mode != ZeroPage && in.Mode != Absolute {
+		return 0, false
+	}
+	return in.Operand, true
+}
+
+// increments is true for INX or INY of the index register
+func (in Instruction) increments(index byte) bool {
+	return in.Opcode.Name == "IN"+string(index)
+}
+
+// endsSequence is true if control may not pass to the next instruction. The
+// zero Instruction stands for bytes that are not an instruction.
+func (in Instruction) endsSequence() bool {
+	return in.Opcode.Length == 0 || in.Branch || in.Jump || in.Call || in.Return || in.Opcode.Name == "BRK"
+}
+
+// detectTables finds tables of addresses used to build a pointer, marking
+// them in Regions and returning true if any were found. The recognized
+// patterns are split tables of low and high bytes
+//
+//  LDA table_lo,X : STA ptr : LDA table_hi,X : STA ptr+1
+//
+// and tables of 16-bit words
+//
+//  LDA table,X : STA ptr : LDA table+1,X : STA ptr+1
+//  LDA table,Y : STA ptr : INY : LDA table,Y : STA ptr+1
+//
+// If the pointer is the target of an indirect jump then the table entries are
+// code entry points, otherwise they are labelled as data. A table runs from
+// its first address up to the next address referenced by the program or the
+// first entry that is not valid, see checkEntries.
+func (d *Disassembler) detectTables() bool {
+	if !d.Tables {
+		return false
+	}
+
+	var insns []Instruction
+	jumpVectors := make(map[uint]bool)
+	d.walk(vtCode, func(cursor, _ uint, in Instruction, err error) int {
+		if err != nil {
+			insns = append(insns, Instruction{})
+			return 1
+		}
+		insns = append(insns, in)
+		if in.Jump && in.Mode == Indirect {
+			jumpVectors[in.Operand] = true
+		}
+		return int(in.Length())
+	}, nil)
+
+	found := false
+	for i, first := range insns {
+		reg1, index, addr1, ok := first.indexedLoad()
+		if !ok {
+			continue
+		}
+
+		// The loaded byte is stored, then the other half of the pointer is
+		// loaded with the same index and stored next to it
+		var ptr1 uint
+		stored := false
+		steps := 0
+		for j := i + 1; j < len(insns) && j <= i+tableWindow; j++ {
+			in := insns[j]
+			if in.endsSequence() {
+				break
+			}
+			if !stored {
+				ptr1, stored = in.store(reg1)
+				continue
+			}
+			if in.increments(index) {
+				steps++
+				continue
+			}
+			reg2, index2, addr2, ok := in.indexedLoad()
+			if !ok || index2 != index {
+				continue
+			}
+			for k := j + 1; k < len(insns) && k <= j+3 && !insns[k].endsSequence(); k++ {
+				if ptr2, ok := insns[k].store(reg2); ok {
+					found = d.addTable(addr1, addr2, ptr1, ptr2, steps, jumpVectors) || found
+					break
+				}
+			}
+			break
+		}
+	}
+	return found
+}
+
+// addTable records the table loaded from addr1 and addr2 into the pointer
+// bytes ptr1 and ptr2, with the index incremented steps times in between.
+func (d *Disassembler) addTable(addr1, addr2, ptr1, ptr2 uint, steps int, jumpVectors map[uint]bool) bool {
+	lo, hi, ptr := addr1, addr2, ptr1
+	switch {
+	case ptr2 == ptr1+1:
+	case ptr1 == ptr2+1:
+		lo, hi, ptr = addr2, addr1, ptr2
+	default:
+		return false
+	}
+	code := jumpVectors[ptr]
+
+	switch {
+	case (steps == 0 && hi == lo+1) || (steps == 1 && hi == lo):
+		n := d.tableExtent(lo, lo+1, 2*maxTableEntries) / 2
+		n = d.checkEntries(lo, n, 2, 1, code)
+		if n == 0 {
+			return false
+		}
+		d.Regions.Mark(lo, lo+2*n, RegionPointers)
+	case steps == 0 && hi != lo:
+		n := min(d.tableExtent(lo, lo, maxTableEntries), d.tableExtent(hi, hi, maxTableEntries))
+		if hi > lo && hi-lo < n {
+			n = hi - lo
+		} else if lo > hi && lo-hi < n {
+			n = lo - hi
+		}
+		n = d.checkEntries(lo, n, 1, hi-lo, code)
+		if n == 0 {
+			return false
+		}
+		d.Regions.MarkSplit(lo, hi, n)
+	default:
+		return false
+	}
+
+	if code {
+		d.addEntryPoints(lo, hi)
+	}
+	return true
+}
+
+// tableExtent returns the number of bytes, up to max, from the program
+// address start that could belong to a table. The table ends at known data or
+// code, or at the next address referenced by the program other than ignore.
+func (d *Disassembler) tableExtent(start, ignore, max uint) uint {
+	if start < d.BranchAdjust+d.Offset || d.Regions.Lookup(start).Type != RegionUnknown {
+		return 0
+	}
+	end := d.BranchAdjust + d.Offset + d.MaxBytes
+	n := uint(0)
+	for addr := start; addr < end && n < max; addr++ {
+		if addr != start && addr != ignore && (d.refCounts[addr] > 0 || d.isCodeTarget(addr)) {
+			break
+		}
+		if d.Regions.Lookup(addr).Type != RegionUnknown {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// isCodeTarget is true if addr is a known instruction boundary
+func (d *Disassembler) isCodeTarget(addr uint) bool {
+	if _, ok := d.branchTargets[addr]; ok || d.entryPoints[addr] {
+		return true
+	}
+	for _, ca := range d.codeAddrs {
+		if ca+d.BranchAdjust == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEntries trims a table of n entries of size bytes at lo, with high
+// bytes at lo+hiOffset, to the entries before the first that is not valid.
+// Code entry points must be inside the program and outside the table, both
+// halves of a split table. Data addresses must be outside the table and
+// either inside the program or named by a variable, an OS call or an OS
+// vector.
+func (d *Disassembler) checkEntries(lo, n, size, hiOffset uint, code bool) uint {
+	start := d.BranchAdjust + d.Offset
+	end := start + d.MaxBytes
+	inTable := func(val, table uint) bool { return val >= table && val < table+n*size }
+	for i := uint(0); i < n; i++ {
+		val := d.tableEntry(lo+i*size, lo+i*size+hiOffset)
+		if inTable(val, lo) || (size == 1 && inTable(val, lo+hiOffset)) {
+			return i
+		}
+		if val >= start && val < end {
+			continue
+		}
+		if code || !d.isNamed(val) {
+			return i
+		}
+	}
+	return n
+}
+
+// isNamed is true if addr has the name of a variable, an OS call or an OS
+// vector
+func (d *Disassembler) isNamed(addr uint) bool {
+	if _, ok := d.varNames[addr]; ok {
+		return true
+	}
+	if _, ok := addressToOsCallName[addr]; ok {
+		return true
+	}
+	_, ok := osVectorAddresses[addr]
+	return ok
+}
+
+// tableEntry returns the address made from the program bytes at lo and hi
+func (d *Disassembler) tableEntry(lo, hi uint) uint {
+	return uint(d.Program[d.offsetOf(lo)]) + uint(d.Program[d.offsetOf(hi)])<<8
+}
+
+// addEntryPoints makes the addresses in the table at lo, with high bytes at
+// hi, code entry points.
+func (d *Disassembler) addEntryPoints(lo, hi uint) {
+	r := d.Regions.Lookup(lo)
+	size, hiOffset := uint(1), hi-lo
+	if r.Type == RegionPointers {
+		size, hiOffset = 2, 1
+	}
+	for addr := r.Start; addr+size <= r.End; addr += size {
+		d.entryPoints[d.tableEntry(addr, addr+hiOffset)] = true
+	}
+}
+
+// tablePointers calls fn with each address held by the pointer tables in
+// Regions
+func (d *Disassembler) tablePointers(fn func(val uint)) {
+	for _, r := range d.Regions.Regions() {
+		size, hiOffset := uint(2), uint(1)
+		switch r.Type {
+		case RegionPointers:
+		case RegionPointersLo:
+			size, hiOffset = 1, r.Partner-r.Start
+		default:
+			continue
+		}
+		for addr := r.Start; addr+size <= r.End; addr += size {
+			if d.inProgram(addr) && d.inProgram(addr+hiOffset) {
+				fn(d.tableEntry(addr, addr+hiOffset))
+			}
+		}
+	}
+}
+
+// inProgram is true if the program address addr is inside Program
+func (d *Disassembler) inProgram(addr uint) bool {
+	return addr >= d.BranchAdjust && addr-d.BranchAdjust < uint(len(d.Program))
+}
+
+func min(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,58 @@
+package bbcdisasm
+
+import "testing"
+
+func TestDataTableStopsAtInvalidEntry(t *testing.T) {
+	program := []byte{
+		0xBD, 0x0B, 0x19, // LDA table,X
+		0x85, 0x70, // STA &70
+		0xBD, 0x0C, 0x19, // LDA table+1,X
+		0x85, 0x71, // STA &71
+		0x60,       // RTS
+		0x00, 0x19, // .table EQUW &1900
+		0x00, 0x19, // EQUW &1900
+		'H', 'e', 'l', 'l', 'o', ' ', 'w', 'o', 'r', 'l', 'd', 0x0D,
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.Tables = true
+	d.Strings = &StringDetector{}
+	if err := d.Lines(func(Line) bool { return true }); err != nil {
+		t.Fatalf("Lines: %v", err)
+	}
+
+	if r := d.Regions.Lookup(0x190B); r.Type != RegionPointers || r.Start != 0x190B || r.End != 0x190F {
+		t.Errorf("table is %v &%04X-&%04X, want pointers &190B-&190F", r.Type, r.Start, r.End)
+	}
+	if r := d.Regions.Lookup(0x190F); r.Type != RegionString {
+		t.Errorf("the bytes after the table are %v, want a string", r.Type)
+	}
+}
+
+func TestSplitTableStopsAtEntryIntoHighBytes(t *testing.T) {
+	program := []byte{
+		0xBD, 0x10, 0x19, // LDA table_lo,X
+		0x85, 0x70, // STA &70
+		0xBD, 0x14, 0x19, // LDA table_hi,X
+		0x85, 0x71, // STA &71
+		0x6C, 0x70, 0x00, // JMP (&0070)
+		0x60, 0x60, 0x60, // RTS
+		0x0D, 0x0E, 0x15, 0x0F, // .table_lo
+		0x19, 0x19, 0x19, 0x19, // .table_hi
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.Tables = true
+	if err := d.Lines(func(Line) bool { return true }); err != nil {
+		t.Fatalf("Lines: %v", err)
+	}
+
+	if r := d.Regions.Lookup(0x1910); r.Type != RegionPointersLo || r.End != 0x1912 {
+		t.Errorf("low bytes are %v &%04X-&%04X, want pointers-lo &1910-&1912", r.Type, r.Start, r.End)
+	}
+	if d.entryPoints[0x1915] {
+		t.Error("the high bytes at &1915 are an entry point")
+	}
+}
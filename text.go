@@ -0,0 +1,188 @@
+package bbcdisasm
+
+import (
+	"fmt"
+)
+
+// DefaultStringMinLength is the minimum length of a detected string if
+// StringDetector.MinLength is not set
+const DefaultStringMinLength = 6
+
+// Charset is a set of byte values
+type Charset [256]bool
+
+// Contains is true if b is in the set
+func (c *Charset) Contains(b byte) bool {
+	return c[b]
+}
+
+var namedCharsets = map[string]string{
+	"printable": " -~",                      // all printable ASCII
+	"text":      "A-Za-z0-9 .,:;!?'()&*+/-", // letters, digits and punctuation
+}
+
+// ParseCharset creates a Charset from a list of characters and character
+// ranges, e.g. "A-Z0-9 .", or the name of a predefined set: "printable" for
+// all printable ASCII characters or "text" for letters, digits, space and
+// common punctuation. A - at the end of the list stands for itself.
+func ParseCharset(spec string) (*Charset, error) {
+	if named, ok := namedCharsets[spec]; ok {
+		spec = named
+	}
+	if spec == "" {
+		return nil, fmt.Errorf("empty character set")
+	}
+
+	var c Charset
+	for i := 0; i < len(spec); i++ {
+		if i+2 < len(spec) && spec[i+1] == '-' {
+			if spec[i] > spec[i+2] {
+				return nil, fmt.Errorf("invalid character range %q", spec[i:i+3])
+			}
+			for b := int(spec[i]); b <= int(spec[i+2]); b++ {
+				c[b] = true
+			}
+			i += 2
+			continue
+		}
+		c[spec[i]] = true
+	}
+	return &c, nil
+}
+
+// StringDetector finds text in the program: runs of characters from Charset
+// at least MinLength long. A run may be preceded by a length byte or
+// terminated by a carriage return (as passed to OSCLI), a zero or a final
+// character with the top bit set. Bytes outside the character set are emitted
+// as EQUB so the output still assembles identically.
+type StringDetector struct {
+	MinLength int      // defaults to DefaultStringMinLength
+	Charset   *Charset // defaults to printable ASCII
+}
+
+// detectStrings marks the strings found in the unknown parts of the program
+// as RegionString, returning true if any were found. Strings overlapping an
+// instruction reached from the code, a targeted code address or an entry
+// point are ignored. A string is assumed to start at the first address
+// referenced by an instruction, so it is not merged with preceding code that
+// happens to be made of printable bytes.
+func (d *Disassembler) detectStrings() bool {
+	sd := d.Strings
+	if sd == nil {
+		return false
+	}
+	minLen := sd.MinLength
+	if minLen <= 0 {
+		minLen = DefaultStringMinLength
+	}
+	charset := sd.Charset
+	if charset == nil {
+		charset, _ = ParseCharset("printable")
+	}
+
+	end := d.Offset + d.MaxBytes
+	if end > uint(len(d.Program)) {
+		end = uint(len(d.Program))
+	}
+	reached := d.reachedCode()
+	unknown := func(i uint) bool {
+		return d.Regions.Lookup(i+d.BranchAdjust).Type == RegionUnknown && !reached[i]
+	}
+
+	found := false
+	for i := d.Offset; i < end; {
+		// Find the next run of characters
+		if !charset.Contains(d.Program[i]) || !unknown(i) {
+			i++
+			continue
+		}
+		start := i
+		for i < end && charset.Contains(d.Program[i]) && unknown(i) {
+			i++
+		}
+		stop := i
+		for a := start + 1; a < stop; a++ {
+			if d.refCounts[a+d.BranchAdjust] > 0 {
+				start = a
+				break
+			}
+		}
+		if int(stop-start) < minLen {
+			continue
+		}
+
+		// Include any length prefix or terminator
+		if start > d.Offset && uint(d.Program[start-1]) == stop-start && unknown(start-1) {
+			start--
+		} else if stop < end && unknown(stop) {
+			switch b := d.Program[stop]; {
+			case b == 0x0D || b == 0x00:
+				stop++
+			case b&0x80 != 0 && charset.Contains(b&0x7F):
+				stop++
+			}
+		}
+
+		if !d.overlapsCodeAddr(start, stop) {
+			d.Regions.Mark(start+d.BranchAdjust, stop+d.BranchAdjust, RegionString)
+			found = true
+		}
+		i = stop
+	}
+	return found
+}
+
+// overlapsCodeAddr is true if a targeted code address or an entry point lies
+// in the program offsets [start, end)
+func (d *Disassembler) overlapsCodeAddr(start, end uint) bool {
+	for _, ca := range d.codeAddrs {
+		if ca >= start && ca < end {
+			return true
+		}
+	}
+	for addr := range d.entryPoints {
+		if ca := d.offsetOf(addr); ca >= start && ca < end {
+			return true
+		}
+	}
+	return false
+}
+
+// reachedCode follows the flow of control from the start of the program, the
+// targeted code addresses and the entry points through branches, jumps and
+// calls, returning the program offsets of the bytes of the instructions
+// reached. It stops at data regions and at bytes that are not an instruction.
+func (d *Disassembler) reachedCode() map[uint]bool {
+	end := d.Offset + d.MaxBytes
+	reached := make(map[uint]bool)
+	starts := make(map[uint]bool)
+	todo := append([]uint{d.Offset}, d.codeAddrs...)
+	for addr := range d.entryPoints {
+		todo = append(todo, d.offsetOf(addr))
+	}
+	for len(todo) > 0 {
+		cursor := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		for cursor >= d.Offset && cursor < end && !starts[cursor] {
+			if d.Regions.Lookup(cursor + d.BranchAdjust).Type.isData() {
+				break
+			}
+			in, err := d.CPU.Decode(d.Program[cursor:end], cursor+d.BranchAdjust)
+			if err != nil {
+				break
+			}
+			starts[cursor] = true
+			for i := uint(0); i < in.Length(); i++ {
+				reached[cursor+i] = true
+			}
+			if (in.Branch || in.Jump || in.Call) && in.HasTarget && in.Target >= d.BranchAdjust {
+				todo = append(todo, in.Target-d.BranchAdjust)
+			}
+			if in.Jump || in.Return || in.Opcode.Name == "BRA" || in.Opcode.Name == "BRK" || in.Opcode.Stability == Jam {
+				break
+			}
+			cursor += in.Length()
+		}
+	}
+	return reached
+}
@@ -0,0 +1,36 @@
+package bbcdisasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetectStringsSkipsReachedCode(t *testing.T) {
+	program := []byte{
+		0x85, 0x71, // STA &71
+		0x6C, 0x70, 0x00, // JMP (&0070)
+		'H', 'e', 'l', 'l', 'o', 0x00,
+	}
+	d := NewDisassembler(program)
+	d.BranchAdjust = 0x1900
+	d.MaxBytes = uint(len(program))
+	d.Strings = &StringDetector{MinLength: 3}
+	var sb strings.Builder
+	if err := d.Disassemble(&sb); err != nil {
+		t.Fatalf("Disassemble: %v", err)
+	}
+	src := sb.String()
+
+	for _, want := range []string{"STA &71", "JMP (&0070)", `EQUS "Hello"`} {
+		if !strings.Contains(src, want) {
+			t.Errorf("disassembly does not contain %s:\n%s", want, src)
+		}
+	}
+	diffs, err := d.Verify(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	for _, diff := range diffs {
+		t.Errorf("Verify: %v", diff)
+	}
+}
@@ -0,0 +1,58 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"io"
+)
+
+// Difference is a byte that did not reassemble to the program
+type Difference struct {
+	Address uint
+	Want    byte // the byte of the program
+	Got     byte // the byte assembled
+	Missing bool // nothing was assembled at Address
+	Extra   bool // a byte was assembled outside the program
+}
+
+func (diff Difference) String() string {
+	switch {
+	case diff.Missing:
+		return fmt.Sprintf("&%04X: &%02X was not assembled", diff.Address, diff.Want)
+	case diff.Extra:
+		return fmt.Sprintf("&%04X: &%02X was assembled outside the program", diff.Address, diff.Got)
+	}
+	return fmt.Sprintf("&%04X: assembled &%02X, the program has &%02X", diff.Address, diff.Got, diff.Want)
+}
+
+// Verify assembles src, the output of Disassemble, with Assemble and returns
+// the bytes that differ from the disassembled part of Program. Only the
+// Beebasm dialect can be verified.
+func (d *Disassembler) Verify(src io.Reader) ([]Difference, error) {
+	if dl := d.dialect(); dl != Beebasm {
+		return nil, fmt.Errorf("cannot verify the %s dialect, only beebasm", dl.Name())
+	}
+	asm, err := Assemble(src)
+	if err != nil {
+		return nil, err
+	}
+
+	start := d.BranchAdjust + d.Offset
+	end := start + d.MaxBytes
+	var diffs []Difference
+	for addr := uint(0); addr < uint(len(asm.Memory)); addr++ {
+		if addr < start || addr >= end {
+			if asm.Written[addr] {
+				diffs = append(diffs, Difference{Address: addr, Got: asm.Memory[addr], Extra: true})
+			}
+			continue
+		}
+		want := d.Program[d.offsetOf(addr)]
+		switch {
+		case !asm.Written[addr]:
+			diffs = append(diffs, Difference{Address: addr, Want: want, Missing: true})
+		case asm.Memory[addr] != want:
+			diffs = append(diffs, Difference{Address: addr, Want: want, Got: asm.Memory[addr]})
+		}
+	}
+	return diffs, nil
+}
@@ -0,0 +1,151 @@
+package bbcdisasm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// XRefStyle selects how cross references are written in the disassembly
+type XRefStyle int
+
+// Cross reference styles
+//  XRefNone   - no cross references
+//  XRefLabels - a comment on each label listing the references to it
+//  XRefTable  - a table of every address referred to after the program
+const (
+	XRefNone XRefStyle = iota
+	XRefLabels
+	XRefTable
+)
+
+var xrefStyleNames = []string{"none", "labels", "table"}
+
+func (s XRefStyle) String() string {
+	if int(s) < len(xrefStyleNames) {
+		return xrefStyleNames[s]
+	}
+	return fmt.Sprintf("XRefStyle(%d)", int(s))
+}
+
+// ParseXRefStyle converts a style name, as returned by XRefStyle.String(),
+// into an XRefStyle
+func ParseXRefStyle(s string) (XRefStyle, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, name := range xrefStyleNames {
+		if s == name {
+			return XRefStyle(i), nil
+		}
+	}
+	return XRefNone, fmt.Errorf("unknown cross reference style %q, want one of %s", s, strings.Join(xrefStyleNames, ", "))
+}
+
+// XRef is a reference to an address by the operand of an instruction
+type XRef struct {
+	Addr   uint // the address referred to
+	From   uint // the address of the instruction
+	Access Access
+}
+
+// addXRefs records the references made by an instruction. Indirect jumps
+// refer to their pointer and BBR and BBS read a zero page address as well as
+// branching.
+func (d *Disassembler) addXRefs(in Instruction) {
+	access := in.Opcode.Access()
+	switch {
+	case access == AccessNone:
+		return
+	case in.HasTarget:
+		d.xrefs[in.Target] = append(d.xrefs[in.Target], XRef{in.Target, in.Address, access})
+	case in.Jump:
+		d.xrefs[in.Operand] = append(d.xrefs[in.Operand], XRef{in.Operand, in.Address, access})
+	}
+	if in.Mode == ZeroPageRelative {
+		d.xrefs[in.Operand] = append(d.xrefs[in.Operand], XRef{in.Operand, in.Address, AccessRead})
+	}
+}
+
+// XRefs returns the cross references of the last disassembly, every address
+// referred to by an instruction operand, whether inside the program or not,
+// with the instructions referring to it and how. They are sorted by address
+// and then by the address of the instruction.
+func (d *Disassembler) XRefs() []XRef {
+	var xrefs []XRef
+	for _, refs := range d.xrefs {
+		xrefs = append(xrefs, refs...)
+	}
+	sort.Slice(xrefs, func(i, j int) bool {
+		if xrefs[i].Addr != xrefs[j].Addr {
+			return xrefs[i].Addr < xrefs[j].Addr
+		}
+		return xrefs[i].From < xrefs[j].From
+	})
+	return xrefs
+}
+
+// xrefText lists references to the same address grouped by access, e.g.
+// "read &1903 &1910, write &1920"
+func (d *Disassembler) xrefText(xrefs []XRef) string {
+	dl := d.dialect()
+	var groups []string
+	for access := AccessRead; access <= AccessIndirect; access++ {
+		var from []string
+		for _, x := range xrefs {
+			if x.Access == access {
+				from = append(from, dl.Hex(x.From, 4))
+			}
+		}
+		if len(from) > 0 {
+			groups = append(groups, access.String()+" "+strings.Join(from, " "))
+		}
+	}
+	return strings.Join(groups, ", ")
+}
+
+// labelXRefs returns the comment listing the references to a label, if the
+// labels have cross references and there are any
+func (d *Disassembler) labelXRefs(addr uint) string {
+	if d.CrossReferences != XRefLabels {
+		return ""
+	}
+	if len(d.xrefs[addr]) == 0 {
+		return ""
+	}
+	return "xrefs: " + d.xrefText(d.xrefs[addr])
+}
+
+// xrefTableLines returns the comment lines of the cross reference table, one
+// per address referred to with its name, if it has one
+func (d *Disassembler) xrefTableLines() []Line {
+	if d.CrossReferences != XRefTable || len(d.xrefs) == 0 {
+		return nil
+	}
+	dl := d.dialect()
+	names := make(map[uint]string)
+	for _, sym := range d.Symbols() {
+		if _, ok := names[sym.Addr]; ok {
+			continue
+		}
+		names[sym.Addr] = sym.Name
+		if sym.Kind == SymbolOSCall || sym.Kind == SymbolOSVector {
+			names[sym.Addr] = dl.Symbol(sym.Name)
+		}
+	}
+
+	lines := []Line{
+		{Kind: LineBlank},
+		{Kind: LineComment, Text: "Cross references"},
+		{Kind: LineComment},
+	}
+	xrefs := d.XRefs()
+	for i := 0; i < len(xrefs); {
+		j := i
+		for j < len(xrefs) && xrefs[j].Addr == xrefs[i].Addr {
+			j++
+		}
+		text := fmt.Sprintf("%-6s %-14s %s", dl.Hex(xrefs[i].Addr, 4), names[xrefs[i].Addr], d.xrefText(xrefs[i:j]))
+		lines = append(lines, Line{Kind: LineComment, Text: text})
+		i = j
+	}
+	return lines
+}